@@ -44,6 +44,15 @@ func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authUserData는 auth 쿠키에 저장된 사용자 정보(userid, name, avatar_url)를 리턴한다.
+func authUserData(r *http.Request) (objx.Map, error) {
+	cookie, err := r.Cookie("auth")
+	if err != nil {
+		return nil, err
+	}
+	return objx.FromBase64(cookie.Value)
+}
+
 // 단순히 다른 http.Handler를 저장(래핑)하는 authHandler이다.
 func MustAuth(handler http.Handler) http.Handler {
 	return &authHandler{next: handler}
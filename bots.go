@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// botPrefix는 봇이 보낸 메시지의 UserID 앞에 붙는다.(OAuth 사용자와 겹치지 않도록)
+const botPrefix = "bot-"
+
+// botToken은 REST API로 메시지를 보낼 수 있는 토큰 하나와 그 토큰의 봇 정보이다.
+// 토큰 자체는 만들 때 한 번만 보여주고 SHA-256 해시만 보관한다.
+type botToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatar_url"`
+	Hash      string    `json:"hash,omitempty"`
+	Room      string    `json:"room,omitempty"` // 들어오는 웹훅이면 메시지를 올릴 수 있는 방(비어있으면 모든 방)
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// userID는 봇이 보낸 메시지에 쓰는 userid이다.
+func (b botToken) userID() string {
+	return botPrefix + b.ID
+}
+
+// tokenStore는 봇 토큰을 보관한다. path가 비어있지 않으면 바뀔 때마다 JSON 파일로 저장한다.
+type tokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	Tokens map[string]botToken `json:"tokens"` // ID -> 토큰
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, Tokens: make(map[string]botToken)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Tokens == nil {
+		s.Tokens = make(map[string]botToken)
+	}
+	return s, nil
+}
+
+// save는 토큰 목록을 파일에 쓴다. s.mu를 잡은 상태에서 호출해야 한다.
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand는 실패하지 않는다.
+	}
+	return hex.EncodeToString(b)
+}
+
+// create는 새 봇 토큰을 만들고, 토큰 정보와 토큰 문자열을 리턴한다.
+func (s *tokenStore) create(name, avatarURL, createdBy string) (botToken, string, error) {
+	return s.issue(botToken{Name: name, AvatarURL: avatarURL, CreatedBy: createdBy}, "cbt_")
+}
+
+// createHook은 room 방에만 메시지를 올릴 수 있는 들어오는 웹훅 토큰을 만든다.
+func (s *tokenStore) createHook(room, name, avatarURL, createdBy string) (botToken, string, error) {
+	return s.issue(botToken{Room: room, Name: name, AvatarURL: avatarURL, CreatedBy: createdBy}, "whk_")
+}
+
+// issue는 b에 ID와 토큰을 정해 보관한다.
+func (s *tokenStore) issue(b botToken, prefix string) (botToken, string, error) {
+	token := prefix + randomHex(24)
+	b.ID = randomHex(6)
+	b.Hash = hashToken(token)
+	b.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Tokens[b.ID] = b
+	return b, token, s.save()
+}
+
+// revoke는 id 토큰을 더 쓸 수 없게 한다. 기록은 남겨 둔다.
+func (s *tokenStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.Tokens[id]
+	if !ok {
+		return false, nil
+	}
+	b.Revoked = true
+	s.Tokens[id] = b
+	return true, s.save()
+}
+
+// authenticate는 token에 해당하는 유효한 봇을 찾는다.
+func (s *tokenStore) authenticate(token string) (botToken, bool) {
+	if token == "" {
+		return botToken{}, false
+	}
+	hash := hashToken(token)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, b := range s.Tokens {
+		if b.Hash == hash && !b.Revoked {
+			return b, true
+		}
+	}
+	return botToken{}, false
+}
+
+// get은 id 토큰의 정보를 리턴한다.
+func (s *tokenStore) get(id string) (botToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.Tokens[id]
+	return b, ok
+}
+
+// list는 토큰 정보를 만든 순서대로 리턴한다.(해시는 빼고)
+// room이 비어있지 않으면 그 방의 들어오는 웹훅만 리턴한다.
+func (s *tokenStore) list(room string) []botToken {
+	s.mu.RLock()
+	out := make([]botToken, 0, len(s.Tokens))
+	for _, b := range s.Tokens {
+		if room != "" && b.Room != room {
+			continue
+		}
+		b.Hash = ""
+		out = append(out, b)
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// botAPI는 브라우저 없이(CI, 운영 스크립트 등) 쓰는 REST API이다.
+// POST   /api/rooms/{name}/messages - Authorization: Bearer {token}으로 봇이 메시지를 보낸다. -> 201 {"id", "when"}
+// GET    /api/tokens                - 토큰 목록(모더레이터만, auth 쿠키)
+// POST   /api/tokens                - {"name", "avatar_url"}로 봇 토큰을 만든다.(토큰은 이 응답에서만 볼 수 있음)
+// DELETE /api/tokens/{id}           - 토큰을 폐기한다.
+// GET    /api/rooms/{name}/hooks     - 방의 들어오는 웹훅 목록(모더레이터만, auth 쿠키)
+// POST   /api/rooms/{name}/hooks     - {"name", "avatar_url"}로 들어오는 웹훅 URL을 만든다.(URL은 이 응답에서만 볼 수 있음)
+// DELETE /api/rooms/{name}/hooks/{id} - 들어오는 웹훅을 폐기한다.
+type botAPI struct {
+	rooms  *roomRegistry
+	tokens *tokenStore
+	admins map[string]bool // 토큰을 관리할 수 있는 사용자(userid)
+}
+
+func (a *botAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // ["api", ...]
+	switch {
+	case len(segs) == 4 && segs[1] == "rooms" && segs[3] == "messages" && roomNamePattern.MatchString(segs[2]):
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.post(w, r, segs[2])
+	case len(segs) == 2 && segs[1] == "tokens", len(segs) == 3 && segs[1] == "tokens":
+		a.manage(w, r, segs[2:])
+	case (len(segs) == 4 || len(segs) == 5) && segs[1] == "rooms" && segs[3] == "hooks" && roomNamePattern.MatchString(segs[2]):
+		a.manageHooks(w, r, segs[2], segs[4:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// postRequest는 POST /api/rooms/{name}/messages의 본문이다.
+type postRequest struct {
+	Message string `json:"message"`
+	Parent  int64  `json:"parent,omitempty"` // 스레드 답글로 보낼 때
+	Key     string `json:"key,omitempty"`    // 다시 시도해도 한 번만 올라가도록 붙이는 key
+}
+
+// post는 봇의 메시지를 room.forward로 보내고, 저장된 ID를 받을 때까지 기다렸다가 돌려준다.
+func (a *botAPI) post(w http.ResponseWriter, r *http.Request, name string) {
+	bot, ok := a.tokens.authenticate(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+		http.Error(w, "invalid or revoked token", http.StatusUnauthorized)
+		return
+	}
+	if bot.Room != "" && bot.Room != name {
+		http.Error(w, "token can only post to room "+bot.Room, http.StatusForbidden)
+		return
+	}
+	var req postRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	msg := &message{
+		UserID:    bot.userID(),
+		Name:      bot.Name,
+		Message:   req.Message,
+		When:      time.Now(),
+		AvatarURL: bot.AvatarURL,
+		Key:       req.Key,
+		acked:     make(chan ackPayload, 1),
+	}
+	a.inject(w, name, msg, req.Parent)
+}
+
+// inject는 run 루프 밖에서 만든 메시지를 name 방에 넣고, 처리 결과를 JSON으로 응답한다.
+func (a *botAPI) inject(w http.ResponseWriter, name string, msg *message, parent int64) {
+	ack, status, err := a.submit(name, msg, parent)
+	var fe *frameError
+	switch {
+	case errors.As(err, &fe):
+		writeJSON(w, status, fe.envelope())
+	case err != nil:
+		http.Error(w, err.Error(), status)
+	case ack.Duplicate:
+		writeJSON(w, http.StatusOK, ack)
+	default:
+		writeJSON(w, http.StatusCreated, ack)
+	}
+}
+
+// submit은 run 루프 밖에서 만든 메시지를 name 방에 웹 소켓 클라이언트가 보낸 것처럼 넣고, 저장된 결과를 기다린다.
+// 실패하면 응답할 HTTP 상태 코드와 에러를 리턴한다. msg.acked는 버퍼가 있는 채널이어야 한다.
+func (a *botAPI) submit(name string, msg *message, parent int64) (ackPayload, int, error) {
+	if strings.TrimSpace(msg.Message) == "" {
+		return ackPayload{}, http.StatusBadRequest, errors.New("message must not be empty")
+	}
+	if len(msg.Key) > maxKeyLength {
+		return ackPayload{}, http.StatusBadRequest, errors.New("key is too long")
+	}
+	r := a.rooms.get(name)
+	if r == nil {
+		return ackPayload{}, http.StatusServiceUnavailable, errors.New("server is shutting down")
+	}
+	if sn, ok := r.sanctioned(sanctionBan, msg.UserID); ok { // 봇도 userid로 ban, mute할 수 있다.
+		return ackPayload{}, http.StatusForbidden, &frameError{"banned", "this bot is banned from room " + name + " " + sn.describe()}
+	}
+	if sn, ok := r.sanctioned(sanctionMute, msg.UserID); ok {
+		return ackPayload{}, http.StatusForbidden, &frameError{"muted", "this bot is muted in room " + name + " " + sn.describe()}
+	}
+	if err := r.mentions(msg); err != nil {
+		return ackPayload{}, http.StatusForbidden, err
+	}
+	if parent != 0 {
+		root, err := r.threadRoot(parent)
+		if err != nil {
+			return ackPayload{}, http.StatusBadRequest, err
+		}
+		msg.ParentID = root
+	}
+	select {
+	case r.forward <- msg:
+	case <-r.done: // 방이 정리되는 중
+		return ackPayload{}, http.StatusServiceUnavailable, errors.New("room is closing, try again")
+	}
+	select {
+	case ack := <-msg.acked:
+		return ack, http.StatusOK, nil
+	case <-r.done:
+		return ackPayload{}, http.StatusServiceUnavailable, errors.New("room closed before the message was stored")
+	}
+}
+
+// admin은 auth 쿠키의 사용자가 admins에 있는지 확인한다. 아니면 에러를 응답하고 false를 리턴한다.
+func (a *botAPI) admin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := authUserData(r)
+	if err != nil || user.Get("userid").Str() == "" {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return "", false
+	}
+	me := user.Get("userid").Str()
+	if !a.admins[me] {
+		http.Error(w, "only moderators can manage bot tokens", http.StatusForbidden)
+		return "", false
+	}
+	return me, true
+}
+
+// manage는 토큰 관리 요청을 처리한다. auth 쿠키의 사용자가 admins에 있어야 한다.
+func (a *botAPI) manage(w http.ResponseWriter, r *http.Request, rest []string) {
+	me, ok := a.admin(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.tokens.list(""))
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			Name      string `json:"name"`
+			AvatarURL string `json:"avatar_url"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		b, token, err := a.tokens.create(req.Name, req.AvatarURL, me)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.Hash = ""
+		writeJSON(w, http.StatusCreated, struct {
+			botToken
+			Token string `json:"token"`
+		}{b, token})
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		ok, err := a.tokens.revoke(rest[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBotAPIPost(t *testing.T) {
+	store := newMemoryStore()
+	settings, _ := newSettingsStore(filepath.Join(t.TempDir(), "rooms.json"))
+	reg := newRoomRegistry(func(name string) *room {
+		r := newRoom(name)
+		r.store = store
+		r.settings = settings
+		return r
+	}, time.Minute)
+	tokens, _ := newTokenStore("")
+	bot, token, _ := tokens.create("ci", "http://example.com/ci.png", "admin")
+	srv := httptest.NewServer(&botAPI{rooms: reg, tokens: tokens, admins: map[string]bool{"admin": true}})
+	defer srv.Close()
+
+	post := func(token, body string) (int, ackPayload) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/rooms/ops/messages", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var ack ackPayload
+		json.NewDecoder(res.Body).Decode(&ack)
+		return res.StatusCode, ack
+	}
+
+	status, ack := post(token, `{"message":"build passed","key":"build-42"}`)
+	if status != http.StatusCreated || ack.ID != 1 {
+		t.Fatalf("post = %d %+v; want 201 with ID 1", status, ack)
+	}
+	msg, err := store.Get("ops", ack.ID)
+	if err != nil || msg.UserID != bot.userID() || msg.Name != "ci" || msg.AvatarURL != "http://example.com/ci.png" {
+		t.Errorf("stored message = %+v, %v; want it from the ci bot", msg, err)
+	}
+	if status, again := post(token, `{"message":"build passed","key":"build-42"}`); status != http.StatusOK || !again.Duplicate || again.ID != ack.ID {
+		t.Errorf("retry = %d %+v; want 200 with the original ID", status, again)
+	}
+	if status, _ := post(token, `{"message":""}`); status != http.StatusBadRequest {
+		t.Errorf("empty message = %d; want 400", status)
+	}
+
+	settings.impose("ops", sanctionBan, bot.userID(), sanction{By: "admin", At: time.Now()})
+	if status, _ := post(token, `{"message":"while banned"}`); status != http.StatusForbidden {
+		t.Errorf("banned bot = %d; want 403", status)
+	}
+	settings.lift("ops", sanctionBan, bot.userID())
+
+	tokens.revoke(bot.ID)
+	if status, _ := post(token, `{"message":"after revoke"}`); status != http.StatusUnauthorized {
+		t.Errorf("revoked token = %d; want 401", status)
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	tokens, _ := newTokenStore("")
+	bot, token, err := tokens.create("deploy", "", "admin")
+	if err != nil || !strings.HasPrefix(token, "cbt_") {
+		t.Fatalf("create = %q, %v", token, err)
+	}
+	if got, ok := tokens.authenticate(token); !ok || got.ID != bot.ID {
+		t.Error("authenticate should find the bot by its token")
+	}
+	if _, ok := tokens.authenticate(token + "x"); ok {
+		t.Error("authenticate should reject unknown tokens")
+	}
+	if list := tokens.list(""); len(list) != 1 || list[0].Hash != "" {
+		t.Errorf("list should hide token hashes, got %+v", list)
+	}
+}
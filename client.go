@@ -1,47 +1,191 @@
 package main
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	writeWait      = 10 * time.Second // 소켓에 한 번 쓰는 데 허용하는 시간
+	maxMessageSize = 4096             // 클라이언트가 보낼 수 있는 메시지의 최대 크기(바이트)
+)
+
+// 테스트에서 줄일 수 있도록 변수로 둔다.
+var (
+	pongWait   = 60 * time.Second    // 이 시간 안에 pong(또는 다른 메시지)이 오지 않으면 끊긴 연결로 본다.
+	pingPeriod = (pongWait * 9) / 10 // ping을 보내는 주기(pongWait보다 짧아야 한다.)
+)
+
 type client struct { // client는 한 명의 채팅 사용자를 나타낸다.
 	socket   *websocket.Conn        // socket은 이 클라이언트의 웹 소켓이다(클라이언트와 통신할 수 있는 웹 소켓에 대한 참조)
-	send     chan *message          // send는 메시지가 전송되는 채널
+	send     chan *envelope         // send는 메시지가 전송되는 채널
 	room     *room                  // room은 클라이언트가 채팅하는 방
+	codec    wireCodec              // codec은 Sec-WebSocket-Protocol로 협상한 프레임 형식
 	userData map[string]interface{} // userDatasms는 사용자에 대한 정보를 보유한다.(문자열을 키로 가지고 모든 자료형을 저장할 수 있는 map)
+
+	// 방이 클라이언트를 내보낼 때 send 채널을 닫기 전에 설정하며, write 메소드가 close 프레임에 사용한다.(0이면 보내지 않음)
+	closeCode int
+	closeText string
+
+	lastTyping time.Time    // 마지막으로 전달한 typing 프레임 시각(read 고루틴만 사용)
+	resume     *resumePoint // 다시 연결한 클라이언트가 마지막으로 받은 위치(없으면 nil)
+}
+
+// userID, name, avatarURL은 auth 쿠키에서 가져온 userData의 값을 리턴한다.(없으면 빈 문자열)
+func (c *client) userID() string    { return c.userString("userid") }
+func (c *client) name() string      { return c.userString("name") }
+func (c *client) avatarURL() string { return c.userString("avatar_url") }
+
+func (c *client) userString(key string) string {
+	s, _ := c.userData[key].(string)
+	return s
 }
 
 // 글을 쓰면 소켓에 글이 들어감.
-// read 메소드에서 소켓에 있는 글을 읽고 forward 채널로 메시지를 전송한다.
+// read 메소드에서 소켓에 있는 envelope를 읽고 type에 맞는 핸들러를 호출한다. chat이면 forward 채널로 메시지를 전송한다.
+// ban, mute된 사용자가 보낸 프레임은 핸들러를 호출하기 전에 막는다.(moderate)
 // forward 채널에 메시지가 전송되면 그 메시지를 모든 클라이언트의 send 채널에 메시지를 추가한다.
 // write 메소드에서 각 클라이언트는 send 채널에 의해 메시지를 기다리고 있다가 send 채널에 온 메시지를 수신한다.
 func (c *client) read() {
 	defer c.socket.Close()
+	c.socket.SetReadLimit(maxMessageSize)              // 너무 큰 메시지를 보내면 연결을 끊는다.
+	c.socket.SetReadDeadline(time.Now().Add(pongWait)) // pongWait 동안 아무것도 읽지 못하면 ReadMessage가 에러를 리턴한다.
+	c.socket.SetPongHandler(func(string) error {       // pong을 받을 때마다 마감 시간을 연장한다.
+		c.socket.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 	for { // 무한루프
-		var msg *message
-		err := c.socket.ReadJSON(&msg) // 소켓에서 읽고
+		msgType, data, err := c.socket.ReadMessage() // 소켓에서 읽고
 		if err != nil {
 			return
 		}
-		msg.When = time.Now()
-		msg.Name = c.userData["name"].(string)
-
-		if avatarURL, ok := c.userData["avatar_url"]; ok { // 프로필 사진이 있으면
-			msg.AvatarURL = avatarURL.(string)
+		if msgType != c.codec.MessageType() {
+			err = &frameError{"malformed", "frame type does not match the negotiated subprotocol"}
+		} else if f, ferr := c.codec.Decode(data); ferr != nil { // 형식을 확인한 뒤
+			err = ferr
+		} else {
+			err = c.dispatch(f) // type에 맞는 핸들러로 보낸다.
 		}
+		if err == errRoomClosed {
+			return
+		}
+		if err != nil && !c.room.reply(c, errorEnvelope(err)) { // 잘못된 프레임은 보낸 클라이언트에게만 에러를 알려준다.
+			return
+		}
+	}
+}
+
+// errRoomClosed는 방의 run 루프가 끝나 더 이상 프레임을 처리할 수 없을 때 리턴된다.
+var errRoomClosed = errors.New("chat: room closed")
 
-		c.room.forward <- msg // room의 forward 채널로 계속 전송
+// frameHandlers는 클라이언트가 보낼 수 있는 프레임 종류별 처리 함수이다.
+// 서버만 보내는 종류(system, join, leave, error, ack)는 여기에 없으므로 unknown_type 에러가 된다.
+var frameHandlers = map[string]func(c *client, f *frame) error{
+	typeChat:   (*client).handleChat,
+	typeTyping: (*client).handleTyping,
+	typeRead:   (*client).handleRead,
+	typeDM:     (*client).handleDM,
+	typeEdit:   (*client).handleEdit,
+	typeDelete: (*client).handleDelete,
+
+	typeSubscribe:   (*client).handleSubscribe,
+	typeUnsubscribe: (*client).handleUnsubscribe,
+	typeReact:       (*client).handleReact,
+	typeUnreact:     (*client).handleUnreact,
+}
+
+func (c *client) dispatch(f *frame) error {
+	handler, ok := frameHandlers[f.Type]
+	if !ok {
+		return &frameError{"unknown_type", "unknown frame type " + strconv.Quote(f.Type)}
+	}
+	if err := c.moderate(f); err == errDropped { // ban, mute된 사용자
+		return nil
+	} else if err != nil {
+		return err
 	}
+	return handler(c, f)
 }
 
-func (c *client) write() {
-	defer c.socket.Close()
-	for msg := range c.send {
-		err := c.socket.WriteJSON(msg) // 소켓에서 메시지를 계속 수신
+// handleChat은 chat 프레임을 message로 만들어 room의 forward 채널로 보낸다.
+func (c *client) handleChat(f *frame) error {
+	var p chatPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	if strings.TrimSpace(p.Message) == "" {
+		return &frameError{"invalid", "message must not be empty"}
+	}
+	if len(p.Key) > maxKeyLength {
+		return &frameError{"invalid", "key is too long"}
+	}
+	if isCommand(p.Message) { // /로 시작하면 명령이다.
+		return c.handleCommand(p)
+	}
+	if strings.HasPrefix(p.Message, "//") { // //는 /로 시작하는 일반 메시지를 보낼 때 쓴다.
+		p.Message = p.Message[1:]
+	}
+	msg := &message{
+		UserID:    c.userID(),
+		Name:      c.name(),
+		Key:       p.Key,
+		Message:   p.Message,
+		When:      time.Now(),
+		AvatarURL: c.avatarURL(), // 프로필 사진이 있으면
+	}
+	if err := c.room.mentions(msg); err != nil {
+		return err
+	}
+	if p.Parent != 0 {
+		root, err := c.room.threadRoot(p.Parent)
 		if err != nil {
-			return
+			return err
+		}
+		msg.ParentID = root
+	}
+	select {
+	case c.room.forward <- msg: // room의 forward 채널로 계속 전송
+		return nil
+	case <-c.room.done: // 방이 종료됐다면 더 읽지 않는다.
+		return errRoomClosed
+	}
+}
+
+// write는 send 채널의 메시지를 소켓에 쓰고, pingPeriod마다 ping을 보내 연결이 살아있는지 확인한다.
+// 쓰기에 실패하면 소켓을 닫으므로 read 메소드도 끝나고 클라이언트는 room.leave를 통해 방을 나간다.
+func (c *client) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.socket.Close()
+	}()
+	for {
+		select {
+		case env, ok := <-c.send:
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok { // 방이 send 채널을 닫음
+				if c.closeCode != 0 { // 방에서 내보낸 경우 이유를 close 프레임으로 알려준다.
+					c.socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText))
+				}
+				return
+			}
+			pm, err := env.prepared(c.codec) // 방 전체에 보낸 envelope는 처음 쓰는 클라이언트만 인코딩한다.
+			if err != nil {
+				c.room.tracer.Trace("Failed to encode envelope: ", err)
+				continue
+			}
+			if err := c.socket.WritePreparedMessage(pm); err != nil { // 소켓에서 메시지를 계속 수신
+				return
+			}
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// wireCodec은 envelope를 웹 소켓 프레임으로 바꾸는 방법이다.
+// 클라이언트는 Sec-WebSocket-Protocol 헤더로 원하는 codec을 고르고, 고르지 않으면 JSON을 사용한다.
+// room은 *envelope만 다루므로 codec을 알 필요가 없다.
+type wireCodec interface {
+	// Subprotocol은 Sec-WebSocket-Protocol 헤더에 쓰는 이름이다.
+	Subprotocol() string
+	// MessageType은 이 codec이 사용하는 웹 소켓 프레임 종류(websocket.TextMessage 또는 BinaryMessage)이다.
+	MessageType() int
+	// Encode는 env를 프레임 데이터로 바꾼다.
+	Encode(env *envelope) ([]byte, error)
+	// Decode는 클라이언트가 보낸 프레임 데이터를 frame으로 바꾼다. payload는 frame.decodePayload로 해석한다.
+	Decode(data []byte) (*frame, error)
+}
+
+// jsonCodec은 기본 codec이다.(Sec-WebSocket-Protocol을 보내지 않은 예전 클라이언트도 사용)
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return "chat.v1+json" }
+func (jsonCodec) MessageType() int    { return websocket.TextMessage }
+
+func (jsonCodec) Encode(env *envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+func (jsonCodec) Decode(data []byte) (*frame, error) {
+	return decodeFrame(data)
+}
+
+// msgpackHandle은 MessagePack 인코딩 설정이다. 구조체의 json 태그를 그대로 키로 사용하므로 필드 이름은 JSON과 같다.
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true} // time.Time을 MessagePack timestamp로 쓴다.
+	h.RawToString = true
+	return h
+}()
+
+// msgpackCodec은 메시지가 많은 방을 위한 바이너리 codec이다.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string { return "chat.v1+msgpack" }
+func (msgpackCodec) MessageType() int    { return websocket.BinaryMessage }
+
+func (msgpackCodec) Encode(env *envelope) ([]byte, error) {
+	var buf []byte
+	err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(env)
+	return buf, err
+}
+
+func (msgpackCodec) Decode(data []byte) (*frame, error) {
+	var in struct {
+		V       int       `codec:"v"`
+		Type    string    `codec:"type"`
+		Payload codec.Raw `codec:"payload"`
+	}
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&in); err != nil {
+		return nil, &frameError{"malformed", "invalid MessagePack: " + err.Error()}
+	}
+	if in.Type == "" {
+		return nil, &frameError{"malformed", "missing type"}
+	}
+	if in.V > protocolVersion {
+		return nil, unsupportedVersion(in.V)
+	}
+	f := &frame{V: in.V, Type: in.Type, unmarshal: unmarshalMsgpack}
+	if len(in.Payload) > 0 && !bytes.Equal(in.Payload, []byte{0xc0}) { // 0xc0은 nil
+		f.Payload = []byte(in.Payload)
+	}
+	return f, nil
+}
+
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// codecs는 지원하는 codec 목록이며, 클라이언트가 여러 개를 보내면 앞에 있는 것을 우선한다.
+// 새 codec(예: Protobuf)은 wireCodec을 구현해 여기에 더하면 된다.
+var codecs = []wireCodec{msgpackCodec{}, jsonCodec{}}
+
+// subprotocols는 upgrader에 등록할 Sec-WebSocket-Protocol 이름 목록이다.
+func subprotocols() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Subprotocol()
+	}
+	return names
+}
+
+// codecFor는 협상된 subprotocol에 맞는 codec을 리턴한다. 협상하지 않았으면 JSON을 사용한다.
+func codecFor(subprotocol string) wireCodec {
+	for _, c := range codecs {
+		if c.Subprotocol() == subprotocol {
+			return c
+		}
+	}
+	return jsonCodec{}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// closeKicked는 /kick으로 내보낸 클라이언트에게 보내는 close 코드이다.(4000~4999는 애플리케이션이 정의하는 코드)
+const closeKicked = 4001
+
+const maxNickLength = 32 // /nick으로 정할 수 있는 이름의 최대 길이(글자 수)
+
+// commandNamePattern은 명령 이름에 쓸 수 있는 문자이다.(영문 소문자로 시작)
+var commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// command는 /로 시작하는 채팅 명령 하나이다.
+// 팀에서 쓰는 명령은 init에서 registerCommand로 등록하면 된다. 예:
+//
+//	func init() {
+//		registerCommand(&command{
+//			Name: "roll", Usage: "[sides]", Help: "roll a die", MaxArgs: 1,
+//			Run: func(ctx *commandContext) error {
+//				ctx.announce(fmt.Sprintf("%s rolled %d", ctx.client.name(), rand.Intn(6)+1))
+//				return nil
+//			},
+//		})
+//	}
+type command struct {
+	Name      string // /{Name}으로 호출한다.
+	Usage     string // 인자 설명(예: "<user> [reason]")
+	Help      string // /help에 보여줄 한 줄 설명
+	MinArgs   int    // 최소 인자 수
+	MaxArgs   int    // 최대 인자 수(음수이면 제한 없음)
+	Moderator bool   // 모더레이터만 쓸 수 있는 명령인지
+
+	// Run은 방의 run 루프 안에서 실행되므로 방의 상태를 바로 다룰 수 있지만, 오래 걸리는 일을 하면 채팅이 멈춘다.
+	// 에러를 리턴하면 명령을 보낸 클라이언트에게만 error envelope로 알려준다.
+	Run func(ctx *commandContext) error
+}
+
+// commands는 이름별로 등록된 명령이다. init에서만 registerCommand로 바꾸므로 잠금 없이 읽는다.
+var commands = make(map[string]*command)
+
+// registerCommand는 명령을 등록한다. 이름이 올바르지 않거나 이미 등록된 이름이면 패닉을 일으킨다.(http.Handle과 같음)
+func registerCommand(cmd *command) {
+	if !commandNamePattern.MatchString(cmd.Name) || cmd.Run == nil {
+		panic("chat: invalid command " + strconv.Quote(cmd.Name))
+	}
+	if _, dup := commands[cmd.Name]; dup {
+		panic("chat: command /" + cmd.Name + " registered twice")
+	}
+	commands[cmd.Name] = cmd
+}
+
+// usage는 명령의 사용법 한 줄이다.(예: "/kick <user> [reason]")
+func (cmd *command) usage() string {
+	if cmd.Usage == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Usage
+}
+
+// commandContext는 실행 중인 명령 하나의 정보이다.
+type commandContext struct {
+	room   *room
+	client *client  // 명령을 보낸 클라이언트
+	cmd    *command // 실행할 명령
+	args   []string // 따옴표를 풀어 나눈 인자
+	text   string   // 명령 이름 뒤의 원문(앞뒤 공백 제외, /me처럼 문장을 그대로 쓸 때)
+	key    string   // chat 프레임의 key(다시 보내도 한 번만 실행)
+	parent int64    // 스레드 안에서 보낸 명령이면 부모 메시지 ID
+	posted bool     // post로 메시지를 올렸는지(그러면 ack는 메시지가 보낸다.)
+}
+
+// reply는 명령을 보낸 클라이언트에게만 안내 문구를 보낸다.
+func (ctx *commandContext) reply(format string, a ...interface{}) {
+	ctx.room.sendTo(ctx.client, newEnvelope(typeSystem, systemPayload{Message: fmt.Sprintf(format, a...)}))
+}
+
+// announce는 방 전체에 안내 문구를 보낸다.
+func (ctx *commandContext) announce(format string, a ...interface{}) {
+	ctx.room.broadcast(newEnvelope(typeSystem, systemPayload{Message: fmt.Sprintf(format, a...)}))
+}
+
+// moderator는 명령을 보낸 사용자가 모더레이터인지 리턴한다.
+func (ctx *commandContext) moderator() bool {
+	return ctx.room.isModerator(ctx.client.userID())
+}
+
+// post는 명령을 보낸 사용자의 메시지로 text를 방에 올린다. 보통 채팅 메시지와 같이 기록되고 멘션도 처리된다.
+func (ctx *commandContext) post(text string, action bool) error {
+	r, c := ctx.room, ctx.client
+	if sn, ok := r.sanctioned(sanctionMute, c.userID()); ok {
+		return &frameError{"muted", "you are muted in this room " + sn.describe()}
+	}
+	msg := &message{
+		UserID:    c.userID(),
+		Name:      c.name(),
+		Key:       ctx.key,
+		Message:   text,
+		When:      time.Now(),
+		AvatarURL: c.avatarURL(),
+		Action:    action,
+	}
+	if err := r.mentions(msg); err != nil {
+		return err
+	}
+	if ctx.parent != 0 {
+		root, err := r.threadRoot(ctx.parent)
+		if err != nil {
+			return err
+		}
+		msg.ParentID = root
+	}
+	ctx.posted = true
+	r.accept(msg)
+	return nil
+}
+
+// isCommand는 채팅 문장이 명령인지 리턴한다. //로 시작하면 명령이 아니라 앞의 /를 하나 뺀 일반 메시지이다.
+func isCommand(text string) bool {
+	return len(text) > 1 && text[0] == '/' && text[1] != '/' && !unicode.IsSpace(rune(text[1]))
+}
+
+// parseCommand는 "/name args..."를 명령 이름과 원문, 인자로 나눈다.
+// 인자는 공백으로 나누며, 인자를 큰따옴표나 작은따옴표로 시작해 묶으면 공백을 넣을 수 있다.(\는 다음 글자를 그대로 쓴다.)
+func parseCommand(text string) (name, rest string, args []string, err error) {
+	text = strings.TrimPrefix(text, "/")
+	name = text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name, rest = text[:i], strings.TrimSpace(text[i:])
+	}
+	args, err = splitArgs(rest)
+	return strings.ToLower(name), rest, args, err
+}
+
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var quote rune // 지금 열려있는 따옴표(없으면 0)
+	inArg, escaped := false, false
+	for _, ch := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+			cur.WriteRune(ch)
+		case (ch == '"' || ch == '\'') && !inArg: // 인자 중간의 따옴표(it's 등)는 그대로 쓴다.
+			quote, inArg = ch, true
+		case unicode.IsSpace(ch):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, &frameError{"usage", "unterminated quote or escape"}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// handleCommand는 /로 시작하는 chat 프레임을 명령으로 해석해 run 루프로 보낸다.
+// 모르는 명령이나 인자 수가 맞지 않는 명령은 run 루프를 거치지 않고 보낸 클라이언트에게만 에러로 알려준다.
+func (c *client) handleCommand(p chatPayload) error {
+	ctx, err := c.newCommandContext(p)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.room.commands <- ctx:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// newCommandContext는 chat 프레임의 문장에서 명령을 찾고 인자 수를 확인한다.
+func (c *client) newCommandContext(p chatPayload) (*commandContext, error) {
+	name, rest, args, err := parseCommand(p.Message)
+	if err != nil {
+		return nil, err
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return nil, &frameError{"unknown_command", "unknown command /" + name + " (try /help)"}
+	}
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		return nil, &frameError{"usage", "usage: " + cmd.usage()}
+	}
+	return &commandContext{room: c.room, client: c, cmd: cmd, args: args, text: rest, key: p.Key, parent: p.Parent}, nil
+}
+
+// runCommand는 권한을 확인하고 명령을 실행한다. run 루프 안에서만 호출해야 한다.
+// key를 붙여 보낸 명령은 chat 메시지처럼 ack를 보내고, 같은 key로 다시 보내면 실행하지 않는다.
+func (r *room) runCommand(ctx *commandContext) {
+	probe := &message{UserID: ctx.client.userID(), Key: ctx.key, When: time.Now()}
+	if r.duplicate(probe) {
+		return
+	}
+	var err error
+	if ctx.cmd.Moderator && !ctx.moderator() {
+		err = &frameError{"forbidden", "/" + ctx.cmd.Name + " is only available to moderators"}
+	} else {
+		err = ctx.cmd.Run(ctx)
+	}
+	if err != nil && r.clients[ctx.client] { // 명령 때문에 방에서 나갔을 수 있다.
+		r.sendTo(ctx.client, errorEnvelope(err))
+	}
+	if !ctx.posted {
+		r.acknowledge(probe)
+	}
+}
+
+// topicPayload는 topic envelope의 payload이며 방의 주제이다.
+type topicPayload struct {
+	Topic string    `json:"topic"`
+	By    string    `json:"by,omitempty"`
+	When  time.Time `json:"when,omitempty"`
+}
+
+// invitePayload는 invite envelope의 payload이다.
+type invitePayload struct {
+	Room   string `json:"room"`
+	From   string `json:"from"`
+	FromID string `json:"from_id"`
+}
+
+// nick은 userID 사용자가 이 방에서 쓰는 이름을 리턴한다. /nick으로 정하지 않았으면 빈 문자열이다.
+func (r *room) nick(userID string) string {
+	if r.settings == nil {
+		return ""
+	}
+	return r.settings.nick(r.name, userID)
+}
+
+// displayName은 c가 이 방에서 보이는 이름이다.
+func (r *room) displayName(c *client) string {
+	if nick := r.nick(c.userID()); nick != "" {
+		return nick
+	}
+	return c.name()
+}
+
+// sendTopic은 방의 주제가 있으면 c에게 보낸다. run 루프 안에서만 호출해야 한다.
+func (r *room) sendTopic(c *client) {
+	if r.settings == nil {
+		return
+	}
+	if topic, by, at := r.settings.topic(r.name); topic != "" {
+		r.sendTo(c, newEnvelope(typeTopic, topicPayload{Topic: topic, By: by, When: at}))
+	}
+}
+
+// findMember는 방에 있는 사용자를 userid나 이름(@ 생략 가능)으로 찾는다.
+// 없으면 not_found, 같은 이름인 사용자가 여럿이면 ambiguous 에러를 리턴한다.(아무나 고르지 않는다.)
+func (r *room) findMember(name string) (*member, error) {
+	name = strings.TrimPrefix(name, "@")
+	if m, ok := r.members[name]; ok {
+		return m, nil
+	}
+	key := mentionKey(name)
+	var found *member
+	for _, m := range r.members {
+		if mentionKey(m.Name) != key {
+			continue
+		}
+		if found != nil {
+			return nil, &frameError{"ambiguous", "several people here are called " + name + "; use their userid"}
+		}
+		found = m
+	}
+	if found == nil {
+		return nil, &frameError{"not_found", name + " is not in this room"}
+	}
+	return found, nil
+}
+
+// nameTaken은 name이 userID가 아닌 다른 사용자의 이름이나 userid와 겹치는지 리턴한다.
+// 방에 있는 사용자와, 디렉터리에 있는(지금 없는) 사용자를 모두 확인한다.
+func (r *room) nameTaken(userID, name string) bool {
+	key := mentionKey(name)
+	for id, m := range r.members {
+		if id != userID && (id == name || mentionKey(m.Name) == key) {
+			return true
+		}
+	}
+	if r.registry != nil && r.registry.users != nil {
+		for _, id := range r.registry.users.resolve(name) {
+			if id != userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kick은 userID 사용자의 모든 클라이언트(탭)를 방에서 내보내고, 내보낸 수를 리턴한다. run 루프 안에서만 호출해야 한다.
+func (r *room) kick(userID string, code int, reason string) int {
+	n := 0
+	for c := range r.clients {
+		if c.userID() == userID {
+			c.closeCode = code
+			c.closeText = truncateUTF8(reason, 123) // close 프레임의 이유는 123바이트까지 보낼 수 있다.
+			r.remove(c)
+			n++
+		}
+	}
+	return n
+}
+
+// truncateUTF8은 s를 글자가 깨지지 않게 n바이트 이하로 자른다.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func init() {
+	registerCommand(&command{
+		Name: "me", Usage: "<action>", Help: "describe what you are doing", MinArgs: 1, MaxArgs: -1,
+		Run: func(ctx *commandContext) error {
+			return ctx.post(ctx.text, true)
+		},
+	})
+	registerCommand(&command{
+		Name: "nick", Usage: "[name]", Help: "change your name in this room (no name resets it)", MaxArgs: -1,
+		Run: runNick,
+	})
+	registerCommand(&command{
+		Name: "topic", Usage: "[topic]", Help: "show the room topic; moderators can change it", MaxArgs: -1,
+		Run: runTopic,
+	})
+	registerCommand(&command{
+		Name: "invite", Usage: "<user>", Help: "invite someone who is online to this room", MinArgs: 1, MaxArgs: 1,
+		Run: runInvite,
+	})
+	registerCommand(&command{
+		Name: "kick", Usage: "<user> [reason]", Help: "disconnect someone from this room", MinArgs: 1, MaxArgs: -1, Moderator: true,
+		Run: runKick,
+	})
+	registerCommand(&command{
+		Name: "help", Usage: "[command]", Help: "list commands or show how to use one", MaxArgs: 1,
+		Run: runHelp,
+	})
+}
+
+func runNick(ctx *commandContext) error {
+	r, c := ctx.room, ctx.client
+	if r.settings == nil {
+		return &frameError{"unavailable", "nicknames are not available"}
+	}
+	if sn, ok := r.sanctioned(sanctionMute, c.userID()); ok { // 이름 변경도 방에 알림이 가므로 mute되면 막는다.
+		return &frameError{"muted", "you are muted in this room " + sn.describe()}
+	}
+	nick := ctx.text
+	if utf8.RuneCountInString(nick) > maxNickLength || strings.IndexFunc(nick, unicode.IsControl) >= 0 {
+		return &frameError{"invalid", fmt.Sprintf("name must be at most %d characters", maxNickLength)}
+	}
+	if nick != "" && r.nameTaken(c.userID(), nick) { // 다른 사람(모더레이터 등)으로 보이지 못하게 한다.
+		return &frameError{"conflict", nick + " is already used by someone else"}
+	}
+	old := r.displayName(c)
+	r.settings.setNick(r.name, c.userID(), nick)
+	name := r.displayName(c)
+	if m, ok := r.members[c.userID()]; ok {
+		m.Name = name
+	}
+	if name != old {
+		r.broadcast(newEnvelope(typeRoster, rosterPayload{Members: r.roster()}))
+		ctx.announce("%s is now known as %s", old, name)
+	}
+	return nil
+}
+
+func runTopic(ctx *commandContext) error {
+	r := ctx.room
+	if r.settings == nil {
+		return &frameError{"unavailable", "topics are not available"}
+	}
+	if ctx.text == "" {
+		if topic, by, _ := r.settings.topic(r.name); topic != "" {
+			ctx.reply("Topic: %s (set by %s)", topic, by)
+		} else {
+			ctx.reply("No topic is set.")
+		}
+		return nil
+	}
+	if !ctx.moderator() {
+		return &frameError{"forbidden", "only moderators can change the topic"}
+	}
+	p := topicPayload{Topic: ctx.text, By: r.displayName(ctx.client), When: time.Now()}
+	if ctx.text == "-" { // "/topic -"는 주제를 지운다.
+		p.Topic = ""
+	}
+	r.settings.setTopic(r.name, p.Topic, p.By, p.When)
+	r.broadcast(newEnvelope(typeTopic, p))
+	return nil
+}
+
+func runInvite(ctx *commandContext) error {
+	r, c := ctx.room, ctx.client
+	reg := r.registry
+	if reg == nil || reg.users == nil {
+		return &frameError{"unavailable", "invitations are not available"}
+	}
+	name := strings.TrimPrefix(ctx.args[0], "@")
+	ids := reg.users.resolve(name)
+	switch {
+	case len(ids) == 0:
+		return &frameError{"not_found", "unknown user " + name}
+	case len(ids) > 1:
+		return &frameError{"ambiguous", "several users are called " + name + "; use their userid"}
+	}
+	if _, here := r.members[ids[0]]; here {
+		ctx.reply("%s is already here.", name)
+		return nil
+	}
+	if !reg.isOnline(ids[0]) {
+		return &frameError{"offline", name + " is not online"}
+	}
+	reg.deliver(ids[0], newEnvelope(typeInvite, invitePayload{Room: r.name, From: r.displayName(c), FromID: c.userID()}))
+	ctx.reply("Invited %s to #%s.", name, r.name)
+	return nil
+}
+
+func runKick(ctx *commandContext) error {
+	r := ctx.room
+	m, err := r.findMember(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	if m.UserID == ctx.client.userID() {
+		return &frameError{"invalid", "you cannot kick yourself"}
+	}
+	target, by := m.Name, r.displayName(ctx.client)
+	reason := strings.Join(ctx.args[1:], " ")
+	text := "kicked by " + by
+	if reason != "" {
+		text += ": " + reason
+	}
+	r.kick(m.UserID, closeKicked, text)
+	ctx.announce("%s was %s", target, text)
+	return nil
+}
+
+func runHelp(ctx *commandContext) error {
+	if len(ctx.args) == 1 {
+		cmd, ok := commands[strings.ToLower(strings.TrimPrefix(ctx.args[0], "/"))]
+		if !ok {
+			return &frameError{"unknown_command", "unknown command /" + ctx.args[0]}
+		}
+		ctx.reply("%s - %s", cmd.usage(), cmd.Help)
+		return nil
+	}
+	names := make([]string, 0, len(commands))
+	for name, cmd := range commands {
+		if !cmd.Moderator || ctx.moderator() { // 쓸 수 없는 명령은 보여주지 않는다.
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = commands[name].usage() + " - " + commands[name].Help
+	}
+	ctx.reply("Commands:\n%s", strings.Join(lines, "\n"))
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for in, want := range map[string][]string{
+		"/kick bob":                     {"kick", "bob"},
+		`/kick "bob smith" too noisy`:   {"kick", "bob smith", "too", "noisy"},
+		`/TOPIC it's "a test" \"quoted`: {"topic", "it's", "a test", `"quoted`},
+		"/help":                         {"help"},
+	} {
+		name, _, args, err := parseCommand(in)
+		if got := append([]string{name}, args...); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCommand(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, _, _, err := parseCommand(`/kick "bob`); err == nil {
+		t.Error("an unterminated quote should be an error")
+	}
+	for text, want := range map[string]bool{"/me waves": true, "//not a command": false, "/ spaced": false, "hi /me": false, "/": false} {
+		if isCommand(text) != want {
+			t.Errorf("isCommand(%q) = %v; want %v", text, !want, want)
+		}
+	}
+}
+
+func TestRoomCommands(t *testing.T) {
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	r.settings, _ = newSettingsStore("")
+	r.moderators = map[string]bool{"m": true}
+	join := func(userid, name string) *client { return joinTestClient(r, 20, userid, name) }
+	drain := func(c *client) {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+	run := func(c *client, text string) error {
+		drain(c)
+		return runTestCommand(c, text)
+	}
+	mod := join("m", "mod")
+	bob := join("b", "bob")
+	drain(mod)
+
+	if err := run(bob, "/nope"); err == nil || !strings.Contains(err.Error(), "unknown_command") {
+		t.Errorf("unknown command error = %v", err)
+	}
+	if err := run(bob, "/invite"); err == nil || !strings.Contains(err.Error(), "usage: /invite <user>") {
+		t.Errorf("missing argument error = %v", err)
+	}
+
+	run(bob, "/kick mod")
+	if env := <-bob.send; env.Type != typeError || !strings.Contains(env.Payload.(errorPayload).Message, "moderators") {
+		t.Errorf("non-moderator kick should be refused privately, got %+v", env)
+	}
+	if len(mod.send) != 0 {
+		t.Error("the refusal should not be sent to other clients")
+	}
+
+	run(bob, "/nick Bobby")
+	run(bob, "/me waves")
+	msg, _ := r.store.Get("dev", 1)
+	if msg == nil || !msg.Action || msg.Message != "waves" || msg.Name != "Bobby" {
+		t.Errorf("/me should post an action under the new nick, got %+v", msg)
+	}
+	if r.members["b"].Name != "Bobby" {
+		t.Errorf("roster name = %q; want Bobby", r.members["b"].Name)
+	}
+
+	run(mod, "/topic Release day")
+	if topic, by, _ := r.settings.topic("dev"); topic != "Release day" || by != "mod" {
+		t.Errorf("topic = %q by %q; want Release day by mod", topic, by)
+	}
+	drain(bob)
+	run(bob, "/topic mine now")
+	if env := <-bob.send; env.Type != typeError {
+		t.Errorf("non-moderator should not change the topic, got %+v", env)
+	}
+
+	run(mod, `/kick Bobby "spamming links"`)
+	if r.clients[bob] || bob.closeCode != closeKicked || bob.closeText != "kicked by mod: spamming links" {
+		t.Errorf("bob should be kicked with a reason, got close %d %q", bob.closeCode, bob.closeText)
+	}
+	if _, ok := r.members["b"]; ok {
+		t.Error("kicked user should leave the roster")
+	}
+
+	carol := join("c", "carol")
+	run(carol, "/nick MOD")
+	if env := <-carol.send; env.Type != typeError || env.Payload.(errorPayload).Code != "conflict" {
+		t.Errorf("taking a moderator's name should be refused, got %+v", env)
+	}
+	if r.members["c"].Name != "carol" {
+		t.Errorf("refused nick should not change the name, got %q", r.members["c"].Name)
+	}
+	other := join("d", "carol") // 이름이 같은 다른 사용자
+	run(mod, "/kick carol")
+	if env := <-mod.send; env.Type != typeError || env.Payload.(errorPayload).Code != "ambiguous" {
+		t.Errorf("kicking an ambiguous name should be refused, got %+v", env)
+	}
+	if !r.clients[carol] || !r.clients[other] {
+		t.Error("an ambiguous kick should not remove anyone")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// profile은 서버가 알고 있는 사용자 한 명의 정보이다.
+// ChatUser를 구현하므로 Avatar 체인(avatars)으로 프로필 사진을 가져올 수 있다.
+type profile struct {
+	ID         string `json:"userid"`
+	Name       string `json:"name"`
+	AuthAvatar string `json:"auth_avatar_url"` // 로그인할 때 쿠키에 저장된 사진 URL
+}
+
+func (p profile) UniqueID() string  { return p.ID }
+func (p profile) AvatarURL() string { return p.AuthAvatar }
+
+// userDirectory는 한 번이라도 접속한 사용자와 DM 상대 목록을 보관한다.
+// path가 비어있지 않으면 바뀔 때마다 JSON 파일로 저장해 서버를 다시 시작해도 유지한다.
+type userDirectory struct {
+	mu       sync.RWMutex
+	path     string
+	Users    map[string]profile              `json:"users"`    // userid -> 사용자 정보
+	Partners map[string]map[string]time.Time `json:"partners"` // userid -> DM 상대 userid -> 마지막 대화 시각
+}
+
+func newUserDirectory(path string) (*userDirectory, error) {
+	d := &userDirectory{
+		path:     path,
+		Users:    make(map[string]profile),
+		Partners: make(map[string]map[string]time.Time),
+	}
+	if path == "" {
+		return d, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if d.Users == nil {
+		d.Users = make(map[string]profile)
+	}
+	if d.Partners == nil {
+		d.Partners = make(map[string]map[string]time.Time)
+	}
+	return d, nil
+}
+
+// save는 디렉터리를 파일에 쓴다. d.mu를 잡은 상태에서 호출해야 한다.
+func (d *userDirectory) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp" // 쓰다가 끊겨도 기존 파일이 깨지지 않도록 임시 파일에 쓴 뒤 바꾼다.
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// remember는 사용자 정보를 기록한다. 바뀐 내용이 없으면 파일에 쓰지 않는다.
+func (d *userDirectory) remember(p profile) error {
+	if p.ID == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Users[p.ID] == p {
+		return nil
+	}
+	d.Users[p.ID] = p
+	return d.save()
+}
+
+// lookup은 userid로 사용자 정보를 찾는다.
+func (d *userDirectory) lookup(userID string) (profile, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	p, ok := d.Users[userID]
+	return p, ok
+}
+
+// touchDM은 두 사용자가 when에 DM을 주고받았다고 기록한다.
+func (d *userDirectory) touchDM(a, b string, when time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		partners, ok := d.Partners[pair[0]]
+		if !ok {
+			partners = make(map[string]time.Time)
+			d.Partners[pair[0]] = partners
+		}
+		partners[pair[1]] = when
+	}
+	return d.save()
+}
+
+// conversation은 DM 목록의 한 항목이다.
+type conversation struct {
+	UserID    string    `json:"userid"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatar_url"`
+	Last      time.Time `json:"last"`
+}
+
+// conversations는 userID 사용자의 DM 상대를 최근 대화 순서로 리턴한다. 사진은 Avatar 체인으로 가져온다.
+func (d *userDirectory) conversations(userID string, avatar Avatar) []conversation {
+	d.mu.RLock()
+	out := make([]conversation, 0, len(d.Partners[userID]))
+	for partnerID, last := range d.Partners[userID] {
+		p := d.Users[partnerID]
+		out = append(out, conversation{UserID: partnerID, Name: p.Name, Last: last, AvatarURL: p.AuthAvatar})
+	}
+	d.mu.RUnlock()
+
+	for i := range out { // 파일 시스템을 확인할 수 있으므로 잠금 밖에서 처리
+		if url, err := avatar.GetAvatarURL(profile{ID: out[i].UserID, AuthAvatar: out[i].AvatarURL}); err == nil {
+			out[i].AvatarURL = url
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Last.After(out[j].Last) })
+	return out
+}
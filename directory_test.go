@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDMKey(t *testing.T) {
+	if dmKey("a", "b") != dmKey("b", "a") {
+		t.Error("dmKey should not depend on the order of users")
+	}
+	if roomNamePattern.MatchString(dmKey("a", "b")) {
+		t.Error("dmKey should never be a valid room name")
+	}
+}
+
+func TestUserDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	users, err := newUserDirectory(path)
+	if err != nil {
+		t.Fatalf("newUserDirectory should not return an error: %s", err)
+	}
+	users.remember(profile{ID: "a", Name: "alice"})
+	users.remember(profile{ID: "b", Name: "bob", AuthAvatar: "http://avatar/bob"})
+	users.remember(profile{ID: "c", Name: "carol"})
+	start := time.Now()
+	users.touchDM("a", "b", start)
+	users.touchDM("c", "a", start.Add(time.Minute))
+
+	// 다시 읽어도 같은 내용이어야 한다.
+	users, err = newUserDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := users.lookup("b"); !ok || p.Name != "bob" {
+		t.Errorf("lookup(b) = %+v, %v; want bob", p, ok)
+	}
+	convs := users.conversations("a", UseAuthAvatar)
+	if len(convs) != 2 || convs[0].UserID != "c" || convs[1].UserID != "b" {
+		t.Fatalf("conversations should list c then b, got %+v", convs)
+	}
+	if convs[1].AvatarURL != "http://avatar/bob" {
+		t.Errorf("conversations should use the Avatar chain, got %s", convs[1].AvatarURL)
+	}
+}
+
+func TestDMRejectsUnsafeUserID(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileStore(filepath.Join(dir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reg := newRoomRegistry(newRoom, time.Minute)
+	reg.users, _ = newUserDirectory("")
+	reg.users.remember(profile{ID: "abc", Name: "abc"})
+	r := newRoom("dev")
+	r.store, r.registry = store, reg
+
+	evil := &client{room: r, userData: map[string]interface{}{"userid": "../../pwn", "name": "evil"}}
+	f := &frame{V: protocolVersion, Type: typeDM, Payload: []byte(`{"to":"abc","message":"hi"}`)}
+	if err := evil.handleDM(f); err == nil {
+		t.Error("a userid with a path should not be able to send DMs")
+	}
+	if err := store.Append(dmKey("../../pwn", "abc"), &message{Message: "hi"}); err == nil {
+		t.Error("the file store should refuse room names that leave its directory")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(matches) != 0 {
+		t.Errorf("log files were written outside the history directory: %v", matches)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// userIDPattern은 DM 저장소 이름에 넣을 수 있는 userid이다.
+// userid는 쿠키에서 오므로 경로 구분자나 ..가 들어간 값으로 history 디렉터리 밖의 파일을 다루지 못하게 막는다.
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// dmKey는 두 사용자의 DM을 저장소에 보관할 때 사용하는 이름이다.
+// 순서와 상관없이 같은 이름이 되도록 정렬하며, 방 이름에 쓸 수 없는 '~'를 넣어 일반 방과 겹치지 않게 한다.
+func dmKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return "dm~" + a + "~" + b
+}
+
+// dmPayload는 서버가 양쪽 사용자에게 보내는 dm envelope의 payload이다.
+type dmPayload struct {
+	To      string   `json:"to"`
+	Message *message `json:"message"`
+}
+
+// handleDM은 dm 프레임을 저장하고, 받는 사람과 보낸 사람이 열어둔 모든 클라이언트(탭)에게 보낸다.
+// 방의 상태를 사용하지 않으므로 run 루프를 거치지 않고 read 고루틴에서 처리한다.
+// 방의 mute는 그 방의 대화에만 적용되므로 dm은 막지 않는다.(mutedFrames 참고)
+func (c *client) handleDM(f *frame) error {
+	var p struct { // 클라이언트는 {"to": userid, "message": "..."}를 보낸다.
+		To      string `json:"to"`
+		Message string `json:"message"`
+	}
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	if strings.TrimSpace(p.Message) == "" {
+		return &frameError{"invalid", "message must not be empty"}
+	}
+	reg := c.room.registry
+	if reg == nil || reg.users == nil || c.room.store == nil {
+		return &frameError{"unavailable", "direct messages are not available"}
+	}
+	if !userIDPattern.MatchString(c.userID()) {
+		return &frameError{"forbidden", "your userid cannot be used for direct messages"}
+	}
+	if !userIDPattern.MatchString(p.To) || p.To == c.userID() {
+		return &frameError{"invalid", "invalid recipient"}
+	}
+	if _, ok := reg.users.lookup(p.To); !ok {
+		return &frameError{"not_found", "unknown user " + p.To}
+	}
+	msg := &message{
+		UserID:    c.userID(),
+		Name:      c.name(),
+		Message:   p.Message,
+		When:      time.Now(),
+		AvatarURL: c.avatarURL(),
+	}
+	if err := c.room.store.Append(dmKey(msg.UserID, p.To), msg); err != nil {
+		return err
+	}
+	if err := reg.users.touchDM(msg.UserID, p.To, msg.When); err != nil {
+		c.room.tracer.Trace("Failed to record DM partners: ", err)
+	}
+	env := newEnvelope(typeDM, dmPayload{To: p.To, Message: msg})
+	reg.deliver(p.To, env)
+	reg.deliver(msg.UserID, env) // 보낸 사람의 다른 탭에도 보여준다.
+	return nil
+}
+
+// dmAPI는 DM 목록과 DM 기록을 돌려주는 JSON API이다. MustAuth로 감싸서 등록한다.
+// GET /dms                     - 로그인한 사용자의 DM 상대 목록(최근 대화 순)
+// GET /dms/{userid}/messages    - 상대와 주고받은 메시지(/rooms/{name}/messages와 같은 파라미터)
+type dmAPI struct {
+	store MessageStore
+	users *userDirectory
+}
+
+func (a *dmAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := authUserData(r)
+	if err != nil || user.Get("userid").Str() == "" {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return
+	}
+	me := user.Get("userid").Str()
+	if !userIDPattern.MatchString(me) {
+		http.Error(w, "invalid userid", http.StatusBadRequest)
+		return
+	}
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // ["dms", userid, "messages"]
+	switch {
+	case len(segs) == 1:
+		writeJSON(w, http.StatusOK, a.users.conversations(me, avatars))
+	case len(segs) == 3 && segs[2] == "messages" && userIDPattern.MatchString(segs[1]):
+		q, err := parseHistoryQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msgs, err := a.store.Query(dmKey(me, segs[1]), q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, msgs)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// editPayload는 edit, delete 프레임의 payload이다.(delete는 message를 사용하지 않음)
+type editPayload struct {
+	ID      int64  `json:"id"`
+	Message string `json:"message"`
+}
+
+// editSignal은 client.read가 room에 전달하는 수정/삭제 요청이다.
+type editSignal struct {
+	from    *client
+	id      int64
+	text    string
+	deleted bool
+}
+
+func (c *client) handleEdit(f *frame) error {
+	var p editPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	if strings.TrimSpace(p.Message) == "" {
+		return &frameError{"invalid", "message must not be empty"}
+	}
+	return c.sendEdit(editSignal{from: c, id: p.ID, text: p.Message})
+}
+
+func (c *client) handleDelete(f *frame) error {
+	var p editPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	return c.sendEdit(editSignal{from: c, id: p.ID, deleted: true})
+}
+
+func (c *client) sendEdit(sig editSignal) error {
+	if sig.id <= 0 {
+		return &frameError{"invalid", "id must be positive"}
+	}
+	select {
+	case c.room.edits <- sig:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// isModerator는 userID 사용자가 이 방의 모더레이터인지 리턴한다.
+func (r *room) isModerator(userID string) bool {
+	return userID != "" && r.moderators[userID]
+}
+
+// applyEdit은 권한을 확인한 뒤 메시지를 수정하거나 지우고, 바뀐 메시지를 update 이벤트로 방 전체에 보낸다.
+// 작성자는 editWindow 안에서만 자기 메시지를 수정/삭제할 수 있고, 모더레이터는 언제든 어떤 메시지든 지울 수 있다.
+// run 루프 안에서만 호출해야 한다.
+func (r *room) applyEdit(sig editSignal) {
+	c := sig.from
+	if r.store == nil {
+		r.sendTo(c, errorEnvelope(&frameError{"unavailable", "message history is disabled"}))
+		return
+	}
+	msg, err := r.store.Get(r.name, sig.id)
+	if err == ErrMessageNotFound {
+		r.sendTo(c, errorEnvelope(&frameError{"not_found", "message not found"}))
+		return
+	} else if err != nil {
+		r.sendTo(c, errorEnvelope(err))
+		return
+	}
+	if err := r.canModify(c, msg, sig.deleted); err != nil {
+		r.sendTo(c, errorEnvelope(err))
+		return
+	}
+	if sig.deleted {
+		msg, err = r.store.Delete(r.name, sig.id, c.userID(), time.Now())
+	} else {
+		msg, err = r.store.Edit(r.name, sig.id, sig.text, c.userID(), time.Now())
+	}
+	if err != nil {
+		r.sendTo(c, errorEnvelope(err))
+		return
+	}
+	r.tracer.Trace("Message updated: ", msg.ID)
+	r.publish(newEnvelope(typeUpdate, msg))
+}
+
+// canModify는 c가 msg를 수정(deleting이면 삭제)할 수 있는지 확인한다.
+func (r *room) canModify(c *client, msg *message, deleting bool) error {
+	if msg.Deleted {
+		return &frameError{"invalid", "message was deleted"}
+	}
+	if deleting && r.isModerator(c.userID()) {
+		return nil
+	}
+	if msg.UserID == "" || msg.UserID != c.userID() {
+		return &frameError{"forbidden", "you can only change your own messages"}
+	}
+	if r.editWindow > 0 && time.Since(msg.When) > r.editWindow {
+		return &frameError{"forbidden", "the edit window for this message has passed"}
+	}
+	return nil
+}
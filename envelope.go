@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// protocolVersion은 웹 소켓으로 주고받는 envelope 형식의 버전이다.
+const protocolVersion = 1
+
+// envelope의 type 값
+const (
+	typeChat   = "chat"   // 채팅 메시지(payload: message)
+	typeSystem = "system" // 서버가 보내는 안내 문구(payload: systemPayload)
+	typeJoin   = "join"   // 사용자가 방에 들어옴
+	typeLeave  = "leave"  // 사용자가 방에서 나감
+	typeRoster = "roster" // 방에 있는 사용자 목록(payload: rosterPayload)
+	typeTyping = "typing" // 사용자가 입력 중
+	typeRead   = "read"   // 클라이언트가 메시지를 읽음(payload: readPayload)
+	typeDM     = "dm"     // 1:1 메시지(payload: dmPayload)
+	typeEdit   = "edit"   // 메시지 수정 요청(payload: editPayload)
+	typeDelete = "delete" // 메시지 삭제 요청(payload: editPayload)
+	typeUpdate = "update" // 수정/삭제되거나 답글이 달린 메시지(payload: message)
+	typeReply  = "reply"  // 구독 중인 스레드의 새 답글(payload: message)
+
+	typeReact     = "react"     // 반응 추가 요청(payload: reactPayload)
+	typeUnreact   = "unreact"   // 반응 취소 요청(payload: reactPayload)
+	typeReactions = "reactions" // 메시지의 바뀐 반응 집계(payload: reactionsPayload)
+	typeMention   = "mention"   // 사용자가 멘션됨(payload: mentionPayload)
+	typeSession   = "session"   // 방에 들어오면 가장 먼저 받음(payload: sessionPayload)
+	typeTopic     = "topic"     // 방의 주제(payload: topicPayload)
+	typeInvite    = "invite"    // 다른 사용자가 방으로 초대함(payload: invitePayload)
+
+	typeSubscribe   = "subscribe"   // 스레드 구독 요청(payload: threadPayload)
+	typeUnsubscribe = "unsubscribe" // 스레드 구독 해제 요청(payload: threadPayload)
+
+	typeReceipt  = "receipt"  // 사용자가 어디까지 읽었는지(payload: receiptPayload)
+	typeReceipts = "receipts" // 방의 모든 receipt(payload: receiptsPayload)
+	typeUnread   = "unread"   // 읽지 않은 메시지 수(payload: unreadPayload)
+	typeError    = "error"    // 클라이언트가 보낸 프레임을 처리하지 못함(payload: errorPayload)
+	typeAck      = "ack"      // 클라이언트가 보낸 프레임을 처리함(payload: ackPayload)
+)
+
+// envelope는 서버와 클라이언트가 주고받는 모든 프레임의 공통 형식이다.
+// {"v": 1, "type": "chat", "seq": 42, "payload": {...}}
+type envelope struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"` // 방 전체에 보낸 이벤트의 순서 번호(room.publish가 붙임)
+	Payload interface{} `json:"payload,omitempty"`
+
+	cache frameCache // 인코딩한 프레임(같은 envelope를 여러 클라이언트에게 보낼 때 한 번만 인코딩)
+}
+
+func newEnvelope(typ string, payload interface{}) *envelope {
+	return &envelope{V: protocolVersion, Type: typ, Payload: payload}
+}
+
+type systemPayload struct {
+	Message string `json:"message"`
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// frameError는 클라이언트가 보낸 프레임이 잘못됐을 때 사용하는 에러이며, 그대로 error envelope로 돌려준다.
+type frameError struct {
+	Code    string
+	Message string
+}
+
+func (e *frameError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *frameError) envelope() *envelope {
+	return newEnvelope(typeError, errorPayload{Code: e.Code, Message: e.Message})
+}
+
+// errorEnvelope는 err를 클라이언트에게 보낼 error envelope로 바꾼다.
+func errorEnvelope(err error) *envelope {
+	var fe *frameError
+	if errors.As(err, &fe) {
+		return fe.envelope()
+	}
+	return newEnvelope(typeError, errorPayload{Code: "internal", Message: err.Error()})
+}
+
+// frame은 클라이언트에게서 받은 envelope이다. payload는 type에 따라 각 핸들러가 해석한다.
+// Payload는 프레임을 보낸 codec의 형식 그대로이며, unmarshal이 nil이면 JSON이다.
+type frame struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// chatPayload는 chat 프레임의 payload이다.
+type chatPayload struct {
+	Message string `json:"message"`
+	Parent  int64  `json:"parent,omitempty"` // 스레드 답글이면 부모 메시지 ID
+	Key     string `json:"key,omitempty"`    // 다시 보낼 때도 같은 값을 보내면 한 번만 처리된다.
+}
+
+// legacyFrame은 envelope 이전의 클라이언트가 보내던 {"Message": "..."} 형식이다.
+type legacyFrame struct {
+	Message *string
+}
+
+// decodeFrame은 클라이언트가 보낸 데이터를 frame으로 바꾼다.
+// type이 없고 Message 필드만 있는 예전 형식은 chat 프레임으로 바꿔준다.
+func decodeFrame(data []byte) (*frame, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, &frameError{"malformed", "empty frame"}
+	}
+	if data[0] != '{' {
+		return nil, &frameError{"malformed", "frame must be a JSON object"}
+	}
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, &frameError{"malformed", "invalid JSON: " + err.Error()}
+	}
+	if f.Type == "" { // 예전 클라이언트
+		var legacy legacyFrame
+		if err := json.Unmarshal(data, &legacy); err != nil || legacy.Message == nil {
+			return nil, &frameError{"malformed", "missing type"}
+		}
+		payload, _ := json.Marshal(chatPayload{Message: *legacy.Message})
+		return &frame{V: protocolVersion, Type: typeChat, Payload: payload}, nil
+	}
+	if f.V > protocolVersion {
+		return nil, unsupportedVersion(f.V)
+	}
+	return &f, nil
+}
+
+func unsupportedVersion(v int) error {
+	return &frameError{"unsupported_version", fmt.Sprintf("protocol version %d is not supported", v)}
+}
+
+// decodePayload는 frame의 payload를 v로 디코딩한다. payload가 없거나 null이면 에러를 리턴한다.
+func (f *frame) decodePayload(v interface{}) error {
+	if len(f.Payload) == 0 || bytes.Equal(f.Payload, []byte("null")) {
+		return &frameError{"malformed", f.Type + " frame requires a payload"}
+	}
+	unmarshal := f.unmarshal
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	if err := unmarshal(f.Payload, v); err != nil {
+		return &frameError{"malformed", "invalid " + f.Type + " payload: " + err.Error()}
+	}
+	return nil
+}
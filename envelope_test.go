@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	f, err := decodeFrame([]byte(`{"v":1,"type":"chat","payload":{"message":"hi"}}`))
+	if err != nil {
+		t.Fatalf("decodeFrame should not return an error: %s", err)
+	}
+	var p chatPayload
+	if f.Type != typeChat || f.decodePayload(&p) != nil || p.Message != "hi" {
+		t.Errorf("decodeFrame returned wrong chat frame: %+v", f)
+	}
+
+	// 예전 클라이언트가 보내던 형식
+	f, err = decodeFrame([]byte(`{"Message":"old"}`))
+	if err != nil {
+		t.Fatalf("decodeFrame should accept legacy frames: %s", err)
+	}
+	p = chatPayload{}
+	if f.Type != typeChat || f.decodePayload(&p) != nil || p.Message != "old" {
+		t.Errorf("decodeFrame returned wrong legacy frame: %+v", f)
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	cases := map[string]string{
+		`null`:                    "malformed",
+		``:                        "malformed",
+		`"text"`:                  "malformed",
+		`{"type":`:                "malformed",
+		`{"Name":"no message"}`:   "malformed",
+		`{"v":2,"type":"chat"}`:   "unsupported_version",
+		`{"type":"chat","v":"x"}`: "malformed",
+		`[{"type":"chat"}]`:       "malformed",
+	}
+	for data, code := range cases {
+		_, err := decodeFrame([]byte(data))
+		fe, ok := err.(*frameError)
+		if !ok || fe.Code != code {
+			t.Errorf("decodeFrame(%q) = %v; want %s error", data, err, code)
+		}
+	}
+}
+
+func TestFramePayloadRequired(t *testing.T) {
+	f, _ := decodeFrame([]byte(`{"v":1,"type":"chat","payload":null}`))
+	var p chatPayload
+	if err := f.decodePayload(&p); err == nil {
+		t.Error("decodePayload should reject a null payload")
+	}
+}
+
+func TestDispatchUnknownType(t *testing.T) {
+	c := &client{}
+	for _, typ := range []string{"bogus", typeError, typeSystem} {
+		err := c.dispatch(&frame{V: protocolVersion, Type: typ})
+		if fe, ok := err.(*frameError); !ok || fe.Code != "unknown_type" {
+			t.Errorf("dispatch(%s) = %v; want unknown_type error", typ, err)
+		}
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	mp := codecFor("chat.v1+msgpack")
+	if mp.MessageType() == codecFor("").MessageType() {
+		t.Fatal("msgpack should use binary frames and be negotiated by name")
+	}
+
+	// 클라이언트가 보낸 chat 프레임
+	var data []byte
+	in := map[string]interface{}{"v": 1, "type": "chat", "payload": map[string]interface{}{"message": "hi", "parent": 3}}
+	if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mp.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode should not return an error: %s", err)
+	}
+	var p chatPayload
+	if err := f.decodePayload(&p); err != nil || f.Type != typeChat || p.Message != "hi" || p.Parent != 3 {
+		t.Errorf("decoded %+v, %+v, %v; want a chat frame with message hi and parent 3", f, p, err)
+	}
+
+	// 서버가 보내는 envelope는 JSON과 같은 키를 사용한다.
+	when := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+	out, err := mp.Encode(&envelope{V: protocolVersion, Type: typeChat, Seq: 7, Payload: &message{ID: 1, Name: "bob", Message: "hey", When: when}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		V       int     `codec:"v"`
+		Type    string  `codec:"type"`
+		Seq     uint64  `codec:"seq"`
+		Payload message `codec:"payload"`
+	}
+	if err := codec.NewDecoderBytes(out, msgpackHandle).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != typeChat || got.Seq != 7 || got.Payload.Message != "hey" || !got.Payload.When.Equal(when) {
+		t.Errorf("Encode round trip = %+v", got)
+	}
+
+	if _, err := mp.Decode([]byte{0x81, 0xa1, 'v', 0x01}); err == nil {
+		t.Error("a frame without a type should be rejected")
+	}
+}
@@ -6,11 +6,11 @@ require (
 	github.com/clbanning/x2j v0.0.0-20191024224557-825249438eec // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/stretchr/codecs v0.0.0-20170403063245-04a5b1e1910d // indirect
-	github.com/stretchr/gomniauth v0.0.0-20170717123514-4b6c822be2eb // indirect
-	github.com/stretchr/objx v0.3.0 // indirect
+	github.com/stretchr/gomniauth v0.0.0-20170717123514-4b6c822be2eb
+	github.com/stretchr/objx v0.3.0
 	github.com/stretchr/signature v0.0.0-20160104132143-168b2a1e1b56 // indirect
 	github.com/stretchr/stew v0.0.0-20130812190256-80ef0842b48b // indirect
 	github.com/stretchr/tracer v0.0.0-20140124184152-66d3696bba97 // indirect
-	github.com/ugorji/go/codec v1.2.4 // indirect
+	github.com/ugorji/go/codec v1.2.4
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
 )
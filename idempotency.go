@@ -0,0 +1,81 @@
+package main
+
+import "time"
+
+const (
+	dedupWindow  = 2 * time.Minute // 같은 key로 다시 보낸 메시지를 중복으로 보는 시간
+	maxKeyLength = 64              // 클라이언트가 붙일 수 있는 key의 최대 길이
+)
+
+// ackPayload는 key를 붙여 보낸 메시지가 처리됐을 때 보낸 사용자에게 돌려주는 ack envelope의 payload이다.
+// Duplicate가 true이면 이미 처리된 메시지를 다시 보낸 것이며, 처음 처리했을 때의 ID와 시각을 돌려준다.
+type ackPayload struct {
+	Key       string    `json:"key"`
+	ID        int64     `json:"id"`
+	When      time.Time `json:"when"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+}
+
+// sentKey는 key를 붙여 처리한 메시지의 기록이다.
+type sentKey struct {
+	id   int64
+	when time.Time // 메시지 시각
+	at   time.Time // 처리한 시각(dedupWindow가 지나면 지운다.)
+}
+
+func sentKeyOf(msg *message) string {
+	return msg.UserID + "\x00" + msg.Key
+}
+
+// duplicate는 msg가 dedupWindow 안에 같은 사용자가 같은 key로 보낸 메시지이면 처음 처리한 결과로 ack를 보내고 true를 리턴한다.
+// run 루프 안에서만 호출해야 한다.
+func (r *room) duplicate(msg *message) bool {
+	if msg.Key == "" {
+		return false
+	}
+	prev, ok := r.sentKeys[sentKeyOf(msg)]
+	if !ok || time.Since(prev.at) > dedupWindow {
+		return false
+	}
+	r.tracer.Trace("Duplicate message dropped: ", msg.Key)
+	r.ack(msg, ackPayload{Key: msg.Key, ID: prev.id, When: prev.when, Duplicate: true})
+	return true
+}
+
+// acknowledge는 처리한 msg의 key를 기록하고 보낸 사용자에게 ack를 보낸다. run 루프 안에서만 호출해야 한다.
+func (r *room) acknowledge(msg *message) {
+	if msg.Key != "" {
+		r.sentKeys[sentKeyOf(msg)] = sentKey{id: msg.ID, when: msg.When, at: time.Now()}
+	}
+	r.ack(msg, ackPayload{Key: msg.Key, ID: msg.ID, When: msg.When})
+}
+
+// ack는 msg를 보낸 쪽에 처리 결과를 알려준다.
+// 웹 소켓이 아닌 곳(REST API 등)에서 보냈으면 msg.acked 채널로, key를 붙여 보냈으면 보낸 사용자의 이 방 클라이언트(탭)에게 보낸다.
+// key는 보낸 탭만 알고 있으므로 다른 탭은 무시한다.
+func (r *room) ack(msg *message, p ackPayload) {
+	if msg.acked != nil {
+		select {
+		case msg.acked <- p:
+		default: // 버퍼가 있으므로 기다리는 쪽이 없어도 막히지 않는다.
+		}
+	}
+	if msg.Key == "" {
+		return
+	}
+	env := newEnvelope(typeAck, p)
+	for c := range r.clients {
+		if c.userID() == msg.UserID {
+			r.sendTo(c, env)
+		}
+	}
+}
+
+// expireSentKeys는 dedupWindow가 지난 key 기록을 지운다. run 루프 안에서만 호출해야 한다.
+func (r *room) expireSentKeys(now time.Time) {
+	for k, s := range r.sentKeys {
+		if now.Sub(s.at) > dedupWindow {
+			delete(r.sentKeys, k)
+		}
+	}
+}
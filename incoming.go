@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxIncomingSize는 들어오는 웹훅 본문의 최대 크기이다.(attachments 때문에 채팅 메시지보다 크게 잡는다.)
+const maxIncomingSize = 64 * 1024
+
+// slackPayload는 Slack의 incoming webhook이 받는 JSON 형식이다. 여기서 사용하는 필드만 정의한다.
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Username    string            `json:"username"`
+	IconURL     string            `json:"icon_url"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback   string       `json:"fallback"`
+	Pretext    string       `json:"pretext"`
+	AuthorName string       `json:"author_name"`
+	Title      string       `json:"title"`
+	TitleLink  string       `json:"title_link"`
+	Text       string       `json:"text"`
+	Fields     []slackField `json:"fields"`
+	ImageURL   string       `json:"image_url"`
+	Footer     string       `json:"footer"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// slackLinkPattern은 Slack mrkdwn의 <url|label>, <@userid>, <!here> 같은 표기를 찾는다.
+var slackLinkPattern = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+
+// slackText는 Slack mrkdwn의 링크와 멘션 표기를 일반 텍스트로 바꾼다.
+// <url|label> -> label (url), <url> -> url, <@userid> -> @userid, <!here>/<!channel> -> here/channel
+// <!here> 같은 표기는 방 전체 멘션(모더레이터, announcer만 쓸 수 있음)으로 바꾸지 않는다.(웹훅 글이 403으로 거절되지 않도록)
+func slackText(s string) string {
+	s = slackLinkPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := slackLinkPattern.FindStringSubmatch(m)
+		target, label := sub[1], sub[2]
+		switch {
+		case strings.HasPrefix(target, "@"):
+			return target
+		case strings.HasPrefix(target, "!"):
+			if label != "" {
+				return label
+			}
+			return target[1:]
+		case label == "" || label == target:
+			return target
+		default:
+			return label + " (" + target + ")"
+		}
+	})
+	// Slack은 &, <, >를 이스케이프해서 보내야 한다.
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+// render는 payload를 채팅 메시지 본문으로 바꾼다. attachment는 text 아래에 줄 단위로 붙인다.
+func (p *slackPayload) render() string {
+	var lines []string
+	add := func(s string) {
+		if s = strings.TrimSpace(slackText(s)); s != "" {
+			lines = append(lines, s)
+		}
+	}
+	add(p.Text)
+	for _, at := range p.Attachments {
+		n := len(lines)
+		add(at.Pretext)
+		add(at.AuthorName)
+		switch {
+		case at.Title != "" && at.TitleLink != "":
+			add(at.Title + " (" + at.TitleLink + ")")
+		default:
+			add(at.Title)
+		}
+		add(at.Text)
+		for _, f := range at.Fields {
+			switch {
+			case f.Title != "" && f.Value != "":
+				add(f.Title + ": " + f.Value)
+			default:
+				add(f.Title + f.Value)
+			}
+		}
+		add(at.ImageURL)
+		add(at.Footer)
+		if len(lines) == n { // 보여줄 내용이 없으면 fallback을 쓴다.
+			add(at.Fallback)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodeSlackPayload는 JSON 본문이나 payload 폼 필드(application/x-www-form-urlencoded)를 읽는다.
+func decodeSlackPayload(w http.ResponseWriter, r *http.Request) (*slackPayload, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxIncomingSize)
+	var p slackPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil || json.Unmarshal([]byte(r.PostForm.Get("payload")), &p) != nil {
+			return nil, false
+		}
+		return &p, true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return nil, false
+	}
+	return &p, true
+}
+
+// incomingAPI는 방마다 만든 들어오는 웹훅 URL로 Slack 형식의 메시지를 받는다.
+// POST /hooks/{token} - slackPayload를 방에 메시지로 올린다. -> 200 "ok"(Slack과 같은 응답)
+// 토큰은 /api/rooms/{name}/hooks에서 만들며, 토큰에 정해진 방에만 올릴 수 있다.
+type incomingAPI struct {
+	bots *botAPI
+}
+
+func (a *incomingAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // ["hooks", token]
+	if len(segs) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hook, ok := a.bots.tokens.authenticate(segs[1])
+	if !ok || hook.Room == "" { // 방이 정해지지 않은 봇 토큰은 Authorization 헤더로만 쓴다.
+		http.Error(w, "no_service", http.StatusNotFound)
+		return
+	}
+	p, ok := decodeSlackPayload(w, r)
+	if !ok {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+	msg := &message{
+		UserID:    hook.userID(),
+		Name:      hook.Name,
+		Message:   p.render(),
+		When:      time.Now(),
+		AvatarURL: hook.AvatarURL,
+		acked:     make(chan ackPayload, 1),
+	}
+	if p.Username != "" { // Slack처럼 보낼 때마다 이름과 사진을 바꿀 수 있다.
+		msg.Name = p.Username
+	}
+	if p.IconURL != "" {
+		msg.AvatarURL = p.IconURL
+	}
+	if strings.TrimSpace(msg.Message) == "" {
+		http.Error(w, "no_text", http.StatusBadRequest)
+		return
+	}
+	if _, status, err := a.bots.submit(hook.Room, msg, 0); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// manageHooks는 name 방의 들어오는 웹훅을 관리한다. auth 쿠키의 사용자가 admins에 있어야 한다.
+func (a *botAPI) manageHooks(w http.ResponseWriter, r *http.Request, name string, rest []string) {
+	me, ok := a.admin(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.tokens.list(name))
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			Name      string `json:"name"`
+			AvatarURL string `json:"avatar_url"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		b, token, err := a.tokens.createHook(name, req.Name, req.AvatarURL, me)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.Hash = ""
+		writeJSON(w, http.StatusCreated, struct {
+			botToken
+			URL string `json:"url"`
+		}{b, baseURL(r) + "/hooks/" + token})
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		if b, ok := a.tokens.get(rest[0]); !ok || b.Room != name {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := a.tokens.revoke(rest[0]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// baseURL은 요청을 받은 서버의 주소(scheme://host)이다. 프록시 뒤에 있으면 X-Forwarded-Proto를 따른다.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIncomingWebhook(t *testing.T) {
+	store := newMemoryStore()
+	reg := newRoomRegistry(func(name string) *room {
+		r := newRoom(name)
+		r.store = store
+		return r
+	}, time.Minute)
+	tokens, _ := newTokenStore("")
+	hook, token, _ := tokens.createHook("ops", "alerts", "http://example.com/alerts.png", "admin")
+	bots := &botAPI{rooms: reg, tokens: tokens, admins: map[string]bool{"admin": true}}
+	srv := httptest.NewServer(&incomingAPI{bots: bots})
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/hooks/"+token, "application/json", strings.NewReader(`{
+		"text": "Deploy <https://ci.example.com/42|#42> finished",
+		"username": "deploy-bot",
+		"attachments": [{"title": "Changes", "fields": [{"title": "Commits", "value": "3"}]}, {"fallback": "plain"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("post = %d; want 200", res.StatusCode)
+	}
+	msg, err := store.Get("ops", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Deploy #42 (https://ci.example.com/42) finished\nChanges\nCommits: 3\nplain"
+	if msg.Message != want || msg.Name != "deploy-bot" || msg.UserID != hook.userID() || msg.AvatarURL != "http://example.com/alerts.png" {
+		t.Errorf("stored message = %+v; want %q from deploy-bot", msg, want)
+	}
+
+	form := url.Values{"payload": {`{"text": "from a form", "icon_url": "http://example.com/x.png"}`}}
+	if res, err = http.PostForm(srv.URL+"/hooks/"+token, form); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if msg, _ := store.Get("ops", 2); res.StatusCode != http.StatusOK || msg == nil || msg.Message != "from a form" || msg.AvatarURL != "http://example.com/x.png" {
+		t.Errorf("form post = %d %+v; want the message stored with the payload icon", res.StatusCode, msg)
+	}
+
+	res, _ = http.Post(srv.URL+"/hooks/"+token, "application/json", strings.NewReader(`{"text": "<!here> disk is full"}`))
+	res.Body.Close()
+	if msg, _ := store.Get("ops", 3); res.StatusCode != http.StatusOK || msg == nil || msg.Message != "here disk is full" {
+		t.Errorf("post with <!here> = %d %+v; want it stored as plain text", res.StatusCode, msg)
+	}
+
+	for body, status := range map[string]int{`{"text": ""}`: http.StatusBadRequest, `not json`: http.StatusBadRequest} {
+		res, _ := http.Post(srv.URL+"/hooks/"+token, "application/json", strings.NewReader(body))
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("post %s = %d; want %d", body, res.StatusCode, status)
+		}
+	}
+
+	_, botToken, _ := tokens.create("ci", "", "admin") // 방이 정해지지 않은 봇 토큰은 URL로 쓸 수 없다.
+	tokens.revoke(hook.ID)
+	for _, tok := range []string{token, botToken} {
+		res, _ := http.Post(srv.URL+"/hooks/"+tok, "application/json", strings.NewReader(`{"text": "hi"}`))
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("post with %s = %d; want 404", tok[:4], res.StatusCode)
+		}
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	for in, want := range map[string]string{
+		"<https://example.com>":                "https://example.com",
+		"see <https://example.com|docs>":       "see docs (https://example.com)",
+		"<!here> ping <@alice>":                "here ping @alice",
+		"<!channel> <!date^1|yesterday>":       "channel yesterday",
+		"a &lt;b&gt; &amp; c":                  "a <b> & c",
+		"<mailto:a@example.com|a@example.com>": "a@example.com (mailto:a@example.com)",
+	} {
+		if got := slackText(in); got != want {
+			t.Errorf("slackText(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
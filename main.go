@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/gomniauth"
 	"github.com/stretchr/gomniauth/providers/facebook"
@@ -38,6 +45,12 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { //
 	data := map[string]interface{}{
 		"Host": r.Host,
 	}
+	name, ok := roomName(r.URL.Path, "/chat/") // 채팅 페이지가 접속할 방 이름(/chat/{name}, 없으면 lobby)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data["Room"] = name
 	if authCookie, err := r.Cookie("auth"); err == nil {
 		data["UserData"] = objx.MustFromBase64(authCookie.Value) // authCookie.Value는 user name이 저장되어 있다.
 	}
@@ -47,9 +60,54 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { //
 	// 따라서 chat.html 파일의 소켓 생성하는 라인에서 {{.Host}}를 사용할 수 있다.
 }
 
+// parseUserList는 쉼표로 구분된 userid 목록 플래그를 집합으로 바꾼다.
+func parseUserList(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			set[id] = true
+		}
+	}
+	return set
+}
+
+// parseOverflowFlags는 -overflow와 -room-overflow 플래그를 해석해 기본 정책과 방별 정책을 리턴한다.
+func parseOverflowFlags(def, perRoom string) (map[string]overflowPolicy, overflowPolicy, error) {
+	policy, err := parseOverflowPolicy(def)
+	if err != nil {
+		return nil, policy, err
+	}
+	policies := make(map[string]overflowPolicy)
+	for _, pair := range strings.Split(perRoom, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, policy, fmt.Errorf("invalid room overflow %q", pair)
+		}
+		p, err := parseOverflowPolicy(kv[1])
+		if err != nil {
+			return nil, policy, err
+		}
+		policies[kv[0]] = p
+	}
+	return policies, policy, nil
+}
+
 func main() {
 	var addr = flag.String("addr", ":8080", "The addr of the application.") // *string 타입을 반환(주소)
-	flag.Parse()                                                            // 플래그 파싱
+	var roomIdle = flag.Duration("room-idle", 5*time.Minute, "How long an empty room is kept before it is closed.")
+	var historyDir = flag.String("history", "history", "The directory for message history (empty keeps history in memory).")
+	var historySize = flag.Int("replay", 50, "The number of recent messages sent to a client when it joins.")
+	var editWindow = flag.Duration("edit-window", 15*time.Minute, "How long authors can edit or delete their messages (0 means no limit).")
+	var moderators = flag.String("moderators", "", "Comma-separated userids who can delete any message.")
+	var announcers = flag.String("announcers", "", "Comma-separated userids who can use @here and @room (moderators always can).")
+	var overflow = flag.String("overflow", "drop-oldest", "What to do when a client falls behind: drop-oldest, drop-newest or disconnect.")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for clients to disconnect on shutdown.")
+	var compress = flag.Bool("compress", false, "Negotiate permessage-deflate compression with clients that support it.")
+	var roomOverflow = flag.String("room-overflow", "", "Per-room overflow policies, e.g. ops=disconnect,dev=drop-newest.")
+	flag.Parse() // 플래그 파싱
 	// gomniauth 설정
 	gomniauth.SetSecurityKey("PUT YOUR AUTH KEY HERE")
 	//ClientID := os.Getenv("GOOGLE_CHAT_CLIENT_ID")
@@ -64,14 +122,89 @@ func main() {
 	//r := newRoom(UseAuthAvatar) // 프로필 사진 o
 	//r := newRoom(UseGravatar) // 프로필 사진 gravatar 이미지로 변경
 	//r := newRoom(UseFileSystemAvatar) // 프로필 사진 업로드 가능
-	r := newRoom() // 프로필 사진 업로드 가능(코드 리펙토링), 매개변수 대신 avatars라는 전역변수를 사용
+	//r := newRoom() // 프로필 사진 업로드 가능(코드 리펙토링), 매개변수 대신 avatars라는 전역변수를 사용
+	var store MessageStore = newMemoryStore() // 메시지 기록 저장소(디렉터리를 지정하면 디스크에 보관)
+	if *historyDir != "" {
+		fs, err := newFileStore(*historyDir)
+		if err != nil {
+			log.Fatalln("Error when trying to open history", *historyDir, "-", err)
+		}
+		store = fs
+	}
+
+	overflowPolicies, defaultOverflow, err := parseOverflowFlags(*overflow, *roomOverflow)
+	if err != nil {
+		log.Fatalln("Error when trying to parse overflow policies", "-", err)
+	}
+
+	moderatorSet := parseUserList(*moderators)
+	announcerSet := parseUserList(*announcers)
+
+	upgrader.EnableCompression = *compress
+
+	hooksFile, settingsFile := "", "" // 방마다 등록한 웹훅과 dead letter, 방의 주제와 닉네임(history 디렉터리가 있으면 그 안에 저장)
+	if *historyDir != "" {
+		hooksFile = filepath.Join(*historyDir, "webhooks.json")
+		settingsFile = filepath.Join(*historyDir, "rooms.json")
+	}
+	webhooks, err := newWebhookStore(hooksFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load webhooks", hooksFile, "-", err)
+	}
+	dispatcher := newWebhookDispatcher(webhooks)
+	settings, err := newSettingsStore(settingsFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load room settings", settingsFile, "-", err)
+	}
+
+	rooms := newRoomRegistry(func(name string) *room { // 방은 /room/{name}으로 처음 접속할 때 만들어진다.
+		r := newRoom(name)
+		r.store = store
+		r.historySize = *historySize
+		r.editWindow = *editWindow
+		r.moderators = moderatorSet
+		r.announcers = announcerSet
+		r.hooks = dispatcher
+		r.settings = settings
+		r.overflow = defaultOverflow
+		if p, ok := overflowPolicies[name]; ok { // 방마다 다른 정책을 쓸 수 있다.
+			r.overflow = p
+		}
+		//r.tracer = trace.New(os.Stdout) // 추적 결과를 터미널로 출력하고 싶을 때 사용(Trace의 t에 쓰인 내용이 터미널에 나옴)
+		return r
+	}, *roomIdle)
+
+	usersFile, tokensFile := "", "" // 사용자 정보와 DM 상대 목록, 봇 토큰(history 디렉터리가 있으면 그 안에 저장)
+	if *historyDir != "" {
+		usersFile = filepath.Join(*historyDir, "users.json")
+		tokensFile = filepath.Join(*historyDir, "tokens.json")
+	}
+	rooms.users, err = newUserDirectory(usersFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load users", usersFile, "-", err)
+	}
+	tokens, err := newTokenStore(tokensFile)
+	if err != nil {
+		log.Fatalln("Error when trying to load bot tokens", tokensFile, "-", err)
+	}
 
-	//r.tracer = trace.New(os.Stdout)                           // 추적 결과를 터미널로 출력하고 싶을 때 사용(Trace의 t에 쓰인 내용이 터미널에 나옴)
-	http.Handle("/", MustAuth(&templateHandler{filename: "chat.html"})) // 경로에 요청이 오는지 수신 대기(요청이 오면 HTML 보내기), 채팅
 	// MustAuth는 authHandler를 통한 권한 수행이 먼저 실행되고 인증되면 templateHandler가 실행된다.
+	chat := MustAuth(&templateHandler{filename: "chat.html"})
+	http.Handle("/", chat)                                          // 경로에 요청이 오는지 수신 대기(요청이 오면 HTML 보내기), 채팅
+	http.Handle("/chat/", chat)                                     // /chat/{name}은 name 방의 채팅 페이지
 	http.Handle("/login", &templateHandler{filename: "login.html"}) // 로그인
 	http.HandleFunc("/auth/", loginHandler)                         // 권한 요청
-	http.Handle("/room", r)
+	http.Handle("/room", rooms)                                     // 기본 방(lobby)
+	http.Handle("/room/", rooms)                                    // /room/{name}은 name 방의 웹 소켓
+	bots := &botAPI{rooms: rooms, tokens: tokens, admins: moderatorSet}
+	http.Handle("/api/", bots)                                                       // 봇 토큰으로 메시지를 보내는 REST API
+	http.Handle("/hooks/", &incomingAPI{bots: bots})                                 // Slack 형식의 들어오는 웹훅(URL의 토큰으로 인증)
+	http.Handle("/transport/", newTransportAPI(rooms))                               // 웹 소켓을 쓸 수 없을 때 SSE, long-polling
+	http.Handle("/api/webhooks", &webhookAPI{hooks: webhooks, admins: moderatorSet}) // 방의 이벤트를 받을 웹훅 관리
+	http.Handle("/api/webhooks/", &webhookAPI{hooks: webhooks, admins: moderatorSet})
+	http.Handle("/rooms/", MustAuth(&roomAPI{store: store}))                  // 지난 메시지 조회 등 방에 대한 JSON API
+	http.Handle("/dms", MustAuth(&dmAPI{store: store, users: rooms.users}))   // DM 목록
+	http.Handle("/dms/", MustAuth(&dmAPI{store: store, users: rooms.users}))  // DM 기록
 	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) { // 로그아웃
 		http.SetCookie(w, &http.Cookie{
 			Name:   "auth",
@@ -89,13 +222,39 @@ func main() {
 		http.StripPrefix("/avatars/", // 지정된 접두사를 제거해 경로를 수정한 후 핸들러로 전달(제거하지 않으면 /avatars/avatars/filename과 같은 경로가 된다.)
 			http.FileServer(http.Dir("./avatars")))) // 공개할 폴더를 지정
 
-	// 방을 가져옴
-	go r.run() // 고루틴을 통해 채팅 작업을 백그라운드에서 실행(메인하고 같이 동시에 돌고 run이 무한루프for문이므로 계속 돈다.)
-
 	// 	웹 서버 시작
-	log.Println("starting web server on", *addr)
-	err := http.ListenAndServe(*addr, nil) // 8080 포트에서 웹 서버 시작
-	if err != nil {
-		log.Fatal("ListenAndServe:", err)
+	server := &http.Server{Addr: *addr}
+	go func() {
+		log.Println("starting web server on", *addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed { // 8080 포트에서 웹 서버 시작
+			log.Fatal("ListenAndServe:", err)
+		}
+	}()
+
+	// SIGINT(Ctrl+C)나 SIGTERM(배포)을 받으면 정상 종료한다.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("shutting down web server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout) // 아래 작업 전체에 걸리는 시간 제한
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { // SSE, long-poll 요청은 방이 클라이언트를 내보내야 끝나므로 HTTP 서버 종료와 함께 시작한다.
+		drained <- rooms.shutdown(ctx) // 클라이언트에게 going-away를 보내고 연결이 끊길 때까지 기다린다.
+	}()
+	if err := server.Shutdown(ctx); err != nil { // 새 연결을 받지 않고 처리 중인 HTTP 요청을 기다린다.(웹 소켓은 포함되지 않음)
+		log.Println("Error when trying to shut down web server", "-", err)
+	}
+	if err := <-drained; err != nil {
+		log.Println("Error when trying to drain rooms", "-", err)
+	}
+	// 방이 모두 닫혔으므로 더 보낼 웹훅 이벤트가 없다.
+	dispatcher.close()
+	if err := settings.flush(); err != nil { // 아직 쓰지 않은 방 설정을 디스크에 쓴다.
+		log.Println("Error when trying to save room settings", "-", err)
+	}
+	if err := store.Close(); err != nil { // 남은 기록을 디스크에 쓴다.
+		log.Println("Error when trying to close history", "-", err)
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// @here, @room 멘션 범위
+const (
+	mentionHere = "here" // 지금 방에 접속해 있는 사용자
+	mentionRoom = "room" // 방에 접속해 있거나 방의 메시지를 읽은 적이 있는 사용자
+)
+
+// mentionPattern은 메시지에서 @name 토큰을 찾는다. 이메일 주소(a@b.com)처럼 앞에 글자가 붙은 것은 제외한다.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)`)
+
+// mentionPayload는 멘션된 사용자에게 보내는 mention envelope의 payload이다.
+// 다른 방에 있어도 받을 수 있으므로 어느 방의 메시지인지 함께 보낸다.
+type mentionPayload struct {
+	Room    string   `json:"room"`
+	Message *message `json:"message"`
+}
+
+// parseMentions는 text에 있는 @name 토큰을 중복 없이 리턴한다.(@ 제외, 끝의 문장 부호 제외)
+func parseMentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(m[1], ".-")
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// mentionKey는 이름을 비교하기 위한 값이다. 공백을 빼고 소문자로 바꾼다.("Kim Soo" -> "kimsoo")
+func mentionKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// resolve는 @name 토큰에 해당하는 사용자들의 userid를 리턴한다.
+// userid가 정확히 같거나, 공백을 뺀 이름이 대소문자 구분 없이 같으면 해당 사용자로 본다.(같은 이름이 여럿이면 모두)
+func (d *userDirectory) resolve(name string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.Users[name]; ok {
+		return []string{name}
+	}
+	key := mentionKey(name)
+	var ids []string
+	for id, p := range d.Users {
+		if mentionKey(p.Name) == key {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// canMentionAll은 userID 사용자가 @here, @room을 쓸 수 있는지 리턴한다.
+func (r *room) canMentionAll(userID string) bool {
+	return r.isModerator(userID) || (userID != "" && r.announcers[userID])
+}
+
+// mentions는 msg.Message의 멘션을 해석해 msg.Mentions와 msg.MentionAll을 채운다.
+// 권한 없이 @here, @room을 쓰면 에러를 리턴한다. forward로 보내기 전에(run 루프 밖에서) 호출한다.
+func (r *room) mentions(msg *message) error {
+	var dir *userDirectory
+	if reg := r.registry; reg != nil {
+		dir = reg.users
+	}
+	seen := make(map[string]bool)
+	for _, name := range parseMentions(msg.Message) {
+		switch lower := strings.ToLower(name); lower {
+		case mentionHere, mentionRoom:
+			if !r.canMentionAll(msg.UserID) {
+				return &frameError{"forbidden", "you are not allowed to use @" + lower}
+			}
+			if msg.MentionAll != mentionRoom { // @room이 @here보다 넓다.
+				msg.MentionAll = lower
+			}
+			continue
+		}
+		if dir == nil {
+			continue
+		}
+		for _, id := range dir.resolve(name) {
+			if !seen[id] {
+				seen[id] = true
+				msg.Mentions = append(msg.Mentions, id)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyMentions는 멘션된 사용자에게 mention envelope를 보낸다.
+// 이 방에 있는 클라이언트에게는 바로 보내고, 다른 방에만 있는 사용자에게는 레지스트리를 통해 보낸다.
+// 보낸 사람 자신은 제외한다. run 루프 안에서만 호출해야 한다.
+func (r *room) notifyMentions(msg *message) {
+	targets := make(map[string]bool)
+	for _, id := range msg.Mentions {
+		targets[id] = true
+	}
+	switch msg.MentionAll {
+	case mentionRoom:
+		if r.store != nil {
+			if receipts, err := r.store.Receipts(r.name); err == nil {
+				for id := range receipts {
+					targets[id] = true
+				}
+			}
+		}
+		fallthrough
+	case mentionHere:
+		for id := range r.members {
+			targets[id] = true
+		}
+	}
+	delete(targets, msg.UserID)
+	if len(targets) == 0 {
+		return
+	}
+	env := newEnvelope(typeMention, mentionPayload{Room: r.name, Message: msg})
+	for c := range r.clients {
+		if targets[c.userID()] {
+			r.sendTo(c, env)
+		}
+	}
+	if r.registry != nil {
+		for id := range targets {
+			r.registry.deliverExcept(id, r, env)
+		}
+	}
+}
@@ -5,8 +5,31 @@ import "time"
 // message는 단일 메시지를 나타낸다.(JSON을 보냄)
 // 메시지 문자열 자체를 캡슐화한다.
 type message struct {
-	Name      string
-	Message   string
-	When      time.Time
-	AvatarURL string
+	ID         int64  // ID는 방 안에서 저장된 순서대로 1부터 증가하는 번호(저장소가 정함)
+	UserID     string // UserID는 보낸 사용자의 userid
+	Name       string
+	Message    string
+	When       time.Time
+	AvatarURL  string
+	Key        string     `json:",omitempty"` // 보낸 클라이언트가 붙인 멱등성 key(다시 보내도 한 번만 처리)
+	ParentID   int64      `json:",omitempty"` // 스레드 답글이면 스레드를 시작한 메시지의 ID
+	Replies    int        `json:",omitempty"` // 스레드를 시작한 메시지에 달린 답글 수
+	LastReply  *time.Time `json:",omitempty"` // 마지막 답글 시각(답글이 없으면 nil)
+	Mentions   []string   `json:",omitempty"` // 멘션된 사용자의 userid
+	MentionAll string     `json:",omitempty"` // @here 또는 @room으로 멘션했으면 "here"/"room"
+	Reactions  []reaction `json:",omitempty"` // 이모지별 반응(처음 반응한 순서)
+	Edited     bool       `json:",omitempty"` // 내용이 수정된 적이 있는지
+	Deleted    bool       `json:",omitempty"` // 지워진 메시지인지(Message는 빈 문자열)
+	Action     bool       `json:",omitempty"` // /me로 보낸 동작 메시지인지
+	Revisions  []revision `json:"-"`          // 수정/삭제 전 내용(저장소에만 남고 클라이언트에게는 보내지 않음)
+
+	acked chan ackPayload // 보낸 쪽이 저장된 ID를 기다릴 때 room이 결과를 보내는 채널(버퍼 1, 없으면 nil)
+}
+
+// revision은 메시지가 수정되거나 지워지기 전의 내용이다.
+type revision struct {
+	Message string
+	By      string // 수정하거나 지운 사용자의 userid
+	When    time.Time
+	Deleted bool `json:",omitempty"`
 }
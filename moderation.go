@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// closeBanned는 /ban으로 내보낸 클라이언트에게 보내는 close 코드이다.
+const closeBanned = 4002
+
+// 제재 종류
+const (
+	sanctionBan  = "ban"  // 방에 다시 들어올 수 없음
+	sanctionMute = "mute" // 방에 있지만 메시지를 보낼 수 없음
+)
+
+// sanctionDone은 제재를 알리는 문구에 쓰는 과거형이다.
+var sanctionDone = map[string]string{sanctionBan: "banned", sanctionMute: "muted"}
+
+// sanction은 모더레이터가 한 사용자에게 내린 ban이나 mute이다.
+type sanction struct {
+	Until  time.Time `json:"until,omitempty"` // 끝나는 시각(zero이면 풀 때까지 계속)
+	By     string    `json:"by"`              // 제재한 모더레이터의 userid
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// active는 now에 제재가 아직 유효한지 리턴한다.
+func (s sanction) active(now time.Time) bool {
+	return s.Until.IsZero() || now.Before(s.Until)
+}
+
+// describe는 제재가 언제까지인지 사람이 읽을 수 있는 문구로 리턴한다.
+func (s sanction) describe() string {
+	if s.Until.IsZero() {
+		return "until further notice"
+	}
+	return "until " + s.Until.Format("2006-01-02 15:04")
+}
+
+// sanctions는 kind 제재의 맵을 리턴한다. create가 true이면 없을 때 만든다. s.mu를 잡은 상태에서 호출해야 한다.
+func (rs *roomSettings) sanctions(kind string, create bool) map[string]sanction {
+	m := &rs.Bans
+	if kind == sanctionMute {
+		m = &rs.Mutes
+	}
+	if *m == nil && create {
+		*m = make(map[string]sanction)
+	}
+	return *m
+}
+
+// sanction은 room 방에서 userID 사용자가 받은 kind 제재가 유효하면 리턴한다.
+func (s *settingsStore) sanction(room, kind, userID string) (sanction, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rs, ok := s.Rooms[room]
+	if !ok {
+		return sanction{}, false
+	}
+	sn, ok := rs.sanctions(kind, false)[userID]
+	if !ok || !sn.active(time.Now()) {
+		return sanction{}, false
+	}
+	return sn, true
+}
+
+// impose는 room 방의 userID 사용자에게 kind 제재를 내린다. 끝난 제재는 이때 함께 지운다.
+func (s *settingsStore) impose(room, kind, userID string, sn sanction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.room(room).sanctions(kind, true)
+	for id, old := range m {
+		if !old.active(sn.At) {
+			delete(m, id)
+		}
+	}
+	m[userID] = sn
+	s.save()
+}
+
+// lift는 room 방의 userID 사용자에게 내린 kind 제재를 푼다. 유효한 제재가 없었으면 false를 리턴한다.
+func (s *settingsStore) lift(room, kind, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.room(room).sanctions(kind, false)
+	sn, ok := m[userID]
+	if !ok {
+		return false
+	}
+	delete(m, userID)
+	s.save()
+	return sn.active(time.Now())
+}
+
+// sanctioned는 이 방에서 userID 사용자에게 내려진 kind 제재를 리턴한다.
+func (r *room) sanctioned(kind, userID string) (sanction, bool) {
+	if r.settings == nil || userID == "" {
+		return sanction{}, false
+	}
+	return r.settings.sanction(r.name, kind, userID)
+}
+
+// refuseBanned는 ban된 사용자이면 403으로 응답하고 true를 리턴한다. ServeHTTP와 HTTP transport가 방에 들이기 전에 확인한다.
+func (r *room) refuseBanned(w http.ResponseWriter, userID string) bool {
+	sn, ok := r.sanctioned(sanctionBan, userID)
+	if !ok {
+		return false
+	}
+	http.Error(w, "you are banned from this room "+sn.describe(), http.StatusForbidden)
+	return true
+}
+
+// mutedFrames는 mute된 사용자가 보낼 수 없는(방의 상태를 바꾸는) 프레임이다. typing은 에러 없이 버린다.
+// dm은 방에 속하지 않은 1:1 대화이므로 방의 mute를 적용하지 않는다.(ban은 moderate가 모든 프레임에서 막는다.)
+var mutedFrames = map[string]bool{typeChat: true, typeEdit: true, typeDelete: true, typeReact: true, typeUnreact: true, typeTyping: true}
+
+// moderate는 ban이나 mute된 사용자가 보낸 프레임을 처리하기 전에 막는다.
+// 프레임마다 확인하므로 방에 들어온 뒤에 내려진 제재도 바로 적용된다. 명령(/help 등)은 mute돼도 쓸 수 있다.(/me, /nick은 명령에서 다시 확인한다.)
+func (c *client) moderate(f *frame) error {
+	if sn, ok := c.room.sanctioned(sanctionBan, c.userID()); ok {
+		return &frameError{"banned", "you are banned from this room " + sn.describe()}
+	}
+	if !mutedFrames[f.Type] {
+		return nil
+	}
+	sn, ok := c.room.sanctioned(sanctionMute, c.userID())
+	if !ok {
+		return nil
+	}
+	if f.Type == typeTyping {
+		return errDropped
+	}
+	if f.Type == typeChat {
+		var p chatPayload
+		if f.decodePayload(&p) == nil && isCommand(p.Message) {
+			return nil // /me는 post에서, /nick은 runNick에서 다시 확인한다.
+		}
+	}
+	return &frameError{"muted", "you are muted in this room " + sn.describe()}
+}
+
+// errDropped는 보낸 클라이언트에게 알리지 않고 버리는 프레임이다.(dispatch가 nil로 바꾼다.)
+var errDropped = errors.New("chat: frame dropped")
+
+// parseSanctionDuration은 /ban, /mute의 기간을 해석한다. time.ParseDuration 형식과 일 단위(예: 7d)를 쓸 수 있다.
+func parseSanctionDuration(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, false
+		}
+		return time.Duration(days) * 24 * time.Hour, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// resolveTarget은 제재할 사용자를 찾는다. 방에 없는 사용자도 디렉터리에서 찾으며, 그래도 없으면 not_found 에러를 리턴한다.
+// (오타로 없는 userid에 제재를 거는 일이 없도록 한다.)
+func (r *room) resolveTarget(name string) (userID, display string, err error) {
+	name = strings.TrimPrefix(name, "@")
+	m, err := r.findMember(name)
+	if err == nil {
+		return m.UserID, m.Name, nil
+	}
+	if fe, ok := err.(*frameError); ok && fe.Code == "ambiguous" {
+		return "", "", err
+	}
+	if r.registry != nil && r.registry.users != nil {
+		ids := r.registry.users.resolve(name)
+		if len(ids) > 1 {
+			return "", "", &frameError{"ambiguous", "several users are called " + name + "; use their userid"}
+		}
+		if len(ids) == 1 {
+			p, _ := r.registry.users.lookup(ids[0])
+			return p.ID, p.Name, nil
+		}
+	}
+	return "", "", &frameError{"not_found", "unknown user " + name}
+}
+
+// runSanction은 /ban, /mute를 처리한다. "/ban <user> [duration] [reason]"
+func runSanction(kind string) func(ctx *commandContext) error {
+	return func(ctx *commandContext) error {
+		r := ctx.room
+		if r.settings == nil {
+			return &frameError{"unavailable", "moderation is not available"}
+		}
+		userID, target, err := r.resolveTarget(ctx.args[0])
+		if err != nil {
+			return err
+		}
+		if userID == ctx.client.userID() {
+			return &frameError{"invalid", "you cannot " + kind + " yourself"}
+		}
+		if r.isModerator(userID) {
+			return &frameError{"forbidden", "moderators cannot be " + sanctionDone[kind]}
+		}
+		sn := sanction{By: ctx.client.userID(), At: time.Now()}
+		rest := ctx.args[1:]
+		if len(rest) > 0 {
+			if d, ok := parseSanctionDuration(rest[0]); ok {
+				sn.Until = sn.At.Add(d)
+				rest = rest[1:]
+			}
+		}
+		sn.Reason = strings.Join(rest, " ")
+		r.settings.impose(r.name, kind, userID, sn)
+		text := fmt.Sprintf("%s by %s %s", sanctionDone[kind], r.displayName(ctx.client), sn.describe())
+		if sn.Reason != "" {
+			text += ": " + sn.Reason
+		}
+		if kind == sanctionBan {
+			r.kick(userID, closeBanned, text) // 열려 있는 모든 연결을 끊는다.
+		} else {
+			delete(r.typists, userID)
+		}
+		ctx.announce("%s was %s", target, text)
+		return nil
+	}
+}
+
+// runLift는 /unban, /unmute를 처리한다.
+func runLift(kind string) func(ctx *commandContext) error {
+	return func(ctx *commandContext) error {
+		r := ctx.room
+		if r.settings == nil {
+			return &frameError{"unavailable", "moderation is not available"}
+		}
+		userID, target, err := r.resolveTarget(ctx.args[0])
+		if fe, ok := err.(*frameError); ok && fe.Code == "not_found" { // 디렉터리에 없어도 제재된 userid는 풀 수 있다.(없으면 lift가 not_found)
+			userID = strings.TrimPrefix(ctx.args[0], "@")
+			target, err = userID, nil
+		}
+		if err != nil {
+			return err
+		}
+		if !r.settings.lift(r.name, kind, userID) {
+			return &frameError{"not_found", target + " is not " + sanctionDone[kind]}
+		}
+		ctx.announce("%s was un%s by %s", target, sanctionDone[kind], r.displayName(ctx.client))
+		return nil
+	}
+}
+
+func init() {
+	registerCommand(&command{
+		Name: "ban", Usage: "<user> [duration] [reason]", Help: "disconnect someone and keep them out of this room (e.g. 30m, 7d)",
+		MinArgs: 1, MaxArgs: -1, Moderator: true, Run: runSanction(sanctionBan),
+	})
+	registerCommand(&command{
+		Name: "unban", Usage: "<user>", Help: "let a banned user back into this room",
+		MinArgs: 1, MaxArgs: 1, Moderator: true, Run: runLift(sanctionBan),
+	})
+	registerCommand(&command{
+		Name: "mute", Usage: "<user> [duration] [reason]", Help: "drop someone's messages in this room (e.g. 10m, 1d)",
+		MinArgs: 1, MaxArgs: -1, Moderator: true, Run: runSanction(sanctionMute),
+	})
+	registerCommand(&command{
+		Name: "unmute", Usage: "<user>", Help: "let a muted user talk again",
+		MinArgs: 1, MaxArgs: 1, Moderator: true, Run: runLift(sanctionMute),
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomBanAndMute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.json")
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	r.settings, _ = newSettingsStore(path)
+	r.moderators = map[string]bool{"m": true}
+	join := func(userid, name string) *client { return joinTestClient(r, 20, userid, name) }
+	run := func(c *client, text string) {
+		t.Helper()
+		if err := runTestCommand(c, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frame := func(typ, payload string) *frame {
+		return &frame{V: protocolVersion, Type: typ, Payload: []byte(payload)}
+	}
+	mod := join("m", "mod")
+	bob := join("b", "bob")
+	tab := join("b", "bob")
+	carol := join("c", "carol")
+
+	run(mod, "/mute carol 10m flooding")
+	if err := carol.dispatch(frame(typeChat, `{"message":"hello"}`)); err == nil || !strings.Contains(err.Error(), "muted") {
+		t.Errorf("muted chat = %v; want a muted error", err)
+	}
+	for typ, payload := range map[string]string{typeDelete: `{"id":1}`, typeUnreact: `{"id":1,"emoji":"👍"}`} {
+		if err := carol.dispatch(frame(typ, payload)); err == nil || !strings.Contains(err.Error(), "muted") {
+			t.Errorf("muted %s = %v; want a muted error", typ, err)
+		}
+	}
+	if err := carol.dispatch(frame(typeTyping, `{"active":true}`)); err != nil {
+		t.Errorf("muted typing = %v; want it dropped silently", err)
+	}
+	for len(carol.send) > 0 {
+		<-carol.send
+	}
+	run(carol, "/me waves")
+	if env := <-carol.send; env.Type != typeError || env.Payload.(errorPayload).Code != "muted" {
+		t.Errorf("muted /me should be refused, got %+v", env)
+	}
+	run(carol, "/nick quiet")
+	if env := <-carol.send; env.Type != typeError || env.Payload.(errorPayload).Code != "muted" {
+		t.Errorf("muted /nick should be refused, got %+v", env)
+	}
+	if msgs, _ := r.store.Query("dev", historyQuery{Limit: 10}); len(msgs) != 0 {
+		t.Errorf("muted user posted %d messages", len(msgs))
+	}
+	run(mod, "/unmute carol")
+	if _, muted := r.sanctioned(sanctionMute, "c"); muted {
+		t.Error("carol should be unmuted")
+	}
+
+	run(mod, "/ban bob 1h spam")
+	if r.clients[bob] || r.clients[tab] || bob.closeCode != closeBanned || tab.closeCode != closeBanned {
+		t.Error("ban should disconnect every tab of the user")
+	}
+	w := httptest.NewRecorder()
+	if !r.refuseBanned(w, "b") || w.Code != http.StatusForbidden {
+		t.Errorf("banned user should be refused with 403, got %d", w.Code)
+	}
+
+	if err := r.settings.flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := newSettingsStore(path) // 다시 시작해도 ban은 남아있다.
+	sn, ok := reloaded.sanction("dev", sanctionBan, "b")
+	if !ok || sn.Reason != "spam" || sn.By != "m" || time.Until(sn.Until) < 59*time.Minute {
+		t.Errorf("reloaded ban = %+v, %v; want an hour-long ban for spam", sn, ok)
+	}
+	if _, ok := reloaded.sanction("other", sanctionBan, "b"); ok {
+		t.Error("bans should be scoped to the room")
+	}
+
+	for len(mod.send) > 0 {
+		<-mod.send
+	}
+	run(mod, "/ban nobdy") // 오타
+	if env := <-mod.send; env.Type != typeError || env.Payload.(errorPayload).Code != "not_found" {
+		t.Errorf("banning an unknown user should be refused, got %+v", env)
+	}
+	if _, ok := r.sanctioned(sanctionBan, "nobdy"); ok {
+		t.Error("a typo should not create a ban")
+	}
+
+	r.settings.impose("dev", sanctionBan, "d", sanction{Until: time.Now().Add(-time.Second), At: time.Now().Add(-time.Hour)})
+	if _, ok := r.sanctioned(sanctionBan, "d"); ok {
+		t.Error("an expired ban should not be enforced")
+	}
+
+	for len(carol.send) > 0 {
+		<-carol.send
+	}
+	run(carol, "/ban mod")
+	if env := <-carol.send; env.Type != typeError || env.Payload.(errorPayload).Code != "forbidden" {
+		t.Errorf("non-moderator ban should be refused, got %+v", env)
+	}
+}
+
+func TestParseSanctionDuration(t *testing.T) {
+	for in, want := range map[string]time.Duration{"30m": 30 * time.Minute, "7d": 7 * 24 * time.Hour, "1h30m": 90 * time.Minute} {
+		if got, ok := parseSanctionDuration(in); !ok || got != want {
+			t.Errorf("parseSanctionDuration(%q) = %v, %v; want %v", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{"spam", "-5m", "0d", "d"} {
+		if _, ok := parseSanctionDuration(in); ok {
+			t.Errorf("parseSanctionDuration(%q) should fail", in)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameCache는 envelope를 codec별로 한 번만 인코딩해 두는 곳이다.
+// 방에 보낸 envelope 하나를 모든 클라이언트의 write 고루틴이 함께 쓰므로 잠금이 필요하다.
+type frameCache struct {
+	mu     sync.Mutex
+	frames map[string]*websocket.PreparedMessage // subprotocol -> 인코딩된 프레임
+}
+
+// prepared는 c codec으로 인코딩한 env를 리턴한다. 처음 요청한 write 고루틴이 인코딩하고 나머지는 그 결과를 사용한다.
+// PreparedMessage는 연결마다 압축(permessage-deflate) 여부가 달라도 압축한 프레임을 한 번만 만든다.
+func (env *envelope) prepared(c wireCodec) (*websocket.PreparedMessage, error) {
+	env.cache.mu.Lock()
+	defer env.cache.mu.Unlock()
+	if pm, ok := env.cache.frames[c.Subprotocol()]; ok {
+		return pm, nil
+	}
+	data, err := c.Encode(env)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := websocket.NewPreparedMessage(c.MessageType(), data)
+	if err != nil {
+		return nil, err
+	}
+	if env.cache.frames == nil {
+		env.cache.frames = make(map[string]*websocket.PreparedMessage, 1)
+	}
+	env.cache.frames[c.Subprotocol()] = pm
+	return pm, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchmarkRecipients는 벤치마크에서 한 번의 broadcast를 받는 연결 수이다.
+const benchmarkRecipients = 100
+
+// benchmarkConns는 서버 쪽 웹 소켓 연결 n개를 만든다. 클라이언트 쪽은 받은 프레임을 버린다.
+func benchmarkConns(b *testing.B, n int, compress bool) ([]*websocket.Conn, func()) {
+	up := websocket.Upgrader{EnableCompression: compress}
+	conns := make(chan *websocket.Conn)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	dialer := websocket.Dialer{EnableCompression: compress}
+	var server, clients []*websocket.Conn
+	for i := 0; i < n; i++ {
+		c, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for {
+				_, r, err := c.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, r)
+			}
+		}()
+		clients = append(clients, c)
+		server = append(server, <-conns)
+	}
+	return server, func() {
+		for _, c := range append(server, clients...) {
+			c.Close()
+		}
+		srv.Close()
+	}
+}
+
+func benchmarkEnvelope() *envelope {
+	return newEnvelope(typeChat, &message{
+		ID:      42,
+		UserID:  "1234567890",
+		Name:    "tester",
+		Message: strings.Repeat("hello, world! ", 20),
+		When:    time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC),
+	})
+}
+
+// BenchmarkBroadcastWriteJSON은 예전처럼 연결마다 envelope를 다시 인코딩한다.
+func BenchmarkBroadcastWriteJSON(b *testing.B) {
+	conns, done := benchmarkConns(b, benchmarkRecipients, false)
+	defer done()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		env := benchmarkEnvelope()
+		for _, c := range conns {
+			if err := c.WriteJSON(env); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkBroadcastPrepared는 envelope를 한 번만 인코딩해 모든 연결이 함께 쓴다.
+func BenchmarkBroadcastPrepared(b *testing.B) {
+	benchmarkBroadcastPrepared(b, false)
+}
+
+// BenchmarkBroadcastPreparedCompressed는 permessage-deflate를 사용할 때도 한 번만 압축하는지 확인한다.
+func BenchmarkBroadcastPreparedCompressed(b *testing.B) {
+	benchmarkBroadcastPrepared(b, true)
+}
+
+func benchmarkBroadcastPrepared(b *testing.B, compress bool) {
+	conns, done := benchmarkConns(b, benchmarkRecipients, compress)
+	defer done()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		env := benchmarkEnvelope()
+		for _, c := range conns {
+			pm, err := env.prepared(jsonCodec{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := c.WritePreparedMessage(pm); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEnvelopePrepared(t *testing.T) {
+	env := benchmarkEnvelope()
+	a, err := env.prepared(jsonCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := env.prepared(jsonCodec{}); a != b {
+		t.Error("prepared should encode an envelope once per codec")
+	}
+	if m, _ := env.prepared(msgpackCodec{}); m == a {
+		t.Error("each codec should get its own frame")
+	}
+}
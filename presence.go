@@ -0,0 +1,73 @@
+package main
+
+import "sort"
+
+// member는 방에 들어와 있는 사용자 한 명을 나타낸다.
+// 같은 사용자가 여러 탭으로 접속해도 roster에는 한 번만 나타난다.
+type member struct {
+	UserID    string `json:"userid"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+	conns     int    // 이 사용자가 방에 연결한 클라이언트(탭) 수
+}
+
+// rosterPayload는 roster envelope의 payload이며 방에 있는 사용자 목록이다.
+type rosterPayload struct {
+	Members []member `json:"members"`
+}
+
+// joined는 클라이언트가 방에 들어왔을 때 presence를 갱신한다. run 루프 안에서만 호출해야 한다.
+// 새 클라이언트에게는 roster 스냅샷을 보내고, 사용자의 첫 연결이면 다른 클라이언트에게 join 이벤트를 보낸다.
+func (r *room) joined(c *client) {
+	m, ok := r.members[c.userID()]
+	if !ok {
+		m = &member{UserID: c.userID(), Name: r.displayName(c), AvatarURL: c.avatarURL()}
+		r.members[m.UserID] = m
+	}
+	m.conns++
+	r.sendTo(c, newEnvelope(typeRoster, rosterPayload{Members: r.roster()}))
+	if m.conns == 1 {
+		if r.registry != nil {
+			r.registry.track(m.UserID, r)
+		}
+		r.hook(hookJoin, webhookEvent{User: m})
+		for other := range r.clients {
+			if other != c {
+				r.sendTo(other, newEnvelope(typeJoin, *m)) // 복사본을 보낸다.(write 고루틴이 인코딩하는 동안 run 루프가 바꿀 수 있음)
+			}
+		}
+	}
+}
+
+// left는 클라이언트가 방에서 나갔을 때 presence를 갱신한다. 사용자의 마지막 연결이면 leave 이벤트를 보낸다.
+func (r *room) left(c *client) {
+	m, ok := r.members[c.userID()]
+	if !ok {
+		return
+	}
+	if m.conns--; m.conns > 0 { // 다른 탭이 아직 남아있다.
+		return
+	}
+	delete(r.members, m.UserID)
+	if r.registry != nil {
+		r.registry.untrack(m.UserID, r)
+	}
+	delete(r.typists, m.UserID) // 나간 사용자는 입력 중일 수 없다.(leave 이벤트로 충분)
+	r.broadcast(newEnvelope(typeLeave, *m))
+	r.hook(hookLeave, webhookEvent{User: m})
+}
+
+// roster는 방에 있는 사용자의 복사본을 이름 순서로 리턴한다.
+func (r *room) roster() []member {
+	members := make([]member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Name != members[j].Name {
+			return members[i].Name < members[j].Name
+		}
+		return members[i].UserID < members[j].UserID
+	})
+	return members
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEmojiLength는 반응으로 쓸 수 있는 이모지(또는 :shortcode:)의 최대 글자 수이다.
+const maxEmojiLength = 32
+
+// reaction은 메시지에 달린 이모지 하나의 반응을 모은 것이다.
+type reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"` // 반응한 사용자의 userid(반응한 순서)
+}
+
+// react는 reactions에 userID의 emoji 반응을 더하거나 뺀 새 슬라이스를 리턴한다.
+// 이미 보낸 메시지가 기존 슬라이스를 가지고 있을 수 있으므로(write 고루틴이 인코딩 중) 원본은 바꾸지 않는다.
+func react(reactions []reaction, emoji, userID string, add bool) []reaction {
+	out := make([]reaction, 0, len(reactions)+1)
+	found := false
+	for _, r := range reactions {
+		if r.Emoji != emoji {
+			out = append(out, r)
+			continue
+		}
+		found = true
+		users := r.Users
+		switch has := containsString(r.Users, userID); {
+		case add && !has:
+			users = append(append([]string(nil), r.Users...), userID)
+		case !add && has:
+			users = make([]string, 0, len(r.Users)-1)
+			for _, u := range r.Users {
+				if u != userID {
+					users = append(users, u)
+				}
+			}
+		}
+		if len(users) > 0 {
+			out = append(out, reaction{Emoji: emoji, Count: len(users), Users: users})
+		}
+	}
+	if !found && add {
+		out = append(out, reaction{Emoji: emoji, Count: 1, Users: []string{userID}})
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reactPayload는 react, unreact 프레임의 payload이다.
+type reactPayload struct {
+	ID    int64  `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+// reactionsPayload는 메시지의 반응이 바뀌었을 때 방 전체에 보내는 reactions envelope의 payload이다.
+type reactionsPayload struct {
+	ID        int64      `json:"id"`
+	Reactions []reaction `json:"reactions"`
+}
+
+// reactSignal은 client.read가 room에 전달하는 반응 변경이다.
+type reactSignal struct {
+	from  *client
+	id    int64
+	emoji string
+	add   bool
+}
+
+func (c *client) handleReact(f *frame) error {
+	return c.sendReact(f, true)
+}
+
+func (c *client) handleUnreact(f *frame) error {
+	return c.sendReact(f, false)
+}
+
+func (c *client) sendReact(f *frame, add bool) error {
+	var p reactPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	if p.ID <= 0 {
+		return &frameError{"invalid", "id must be positive"}
+	}
+	emoji := strings.TrimSpace(p.Emoji)
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength || strings.ContainsAny(emoji, " \t\r\n") {
+		return &frameError{"invalid", "invalid emoji"}
+	}
+	select {
+	case c.room.reacts <- reactSignal{from: c, id: p.ID, emoji: emoji, add: add}:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// applyReact는 반응을 저장하고 바뀐 집계를 reactions 이벤트로 방 전체에 보낸다. run 루프 안에서만 호출해야 한다.
+func (r *room) applyReact(sig reactSignal) {
+	c := sig.from
+	if r.store == nil {
+		r.sendTo(c, errorEnvelope(&frameError{"unavailable", "message history is disabled"}))
+		return
+	}
+	msg, err := r.store.Get(r.name, sig.id)
+	if err == ErrMessageNotFound {
+		r.sendTo(c, errorEnvelope(&frameError{"not_found", "message not found"}))
+		return
+	} else if err != nil {
+		r.sendTo(c, errorEnvelope(err))
+		return
+	}
+	if msg.Deleted {
+		r.sendTo(c, errorEnvelope(&frameError{"invalid", "message was deleted"}))
+		return
+	}
+	if msg, err = r.store.React(r.name, sig.id, sig.emoji, c.userID(), sig.add); err != nil {
+		r.sendTo(c, errorEnvelope(err))
+		return
+	}
+	r.publish(newEnvelope(typeReactions, reactionsPayload{ID: msg.ID, Reactions: msg.Reactions}))
+}
@@ -0,0 +1,109 @@
+package main
+
+// readPayload는 클라이언트가 보내는 read 프레임의 payload이다.(id 메시지까지 읽었음)
+type readPayload struct {
+	ID int64 `json:"id"`
+}
+
+// receiptPayload는 사용자가 어디까지 읽었는지 알리는 receipt envelope의 payload이다.
+type receiptPayload struct {
+	UserID string `json:"userid"`
+	Name   string `json:"name,omitempty"`
+	ID     int64  `json:"id"`
+}
+
+// receiptsPayload는 방에 들어왔을 때 받는 사용자별 마지막으로 읽은 메시지 ID이다.
+type receiptsPayload struct {
+	Receipts []receiptPayload `json:"receipts"`
+}
+
+// unreadPayload는 사용자의 읽지 않은 메시지 수이며, HTTP API(/rooms/{name}/unread)에서도 같은 형식을 사용한다.
+type unreadPayload struct {
+	Room     string `json:"room"`
+	LastRead int64  `json:"last_read"`
+	Unread   int    `json:"unread"`
+}
+
+// readSignal은 client.read가 room에 전달하는 읽음 표시이다.
+type readSignal struct {
+	from *client
+	id   int64
+}
+
+// handleRead는 read 프레임을 room에 전달한다.
+func (c *client) handleRead(f *frame) error {
+	var p readPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	if p.ID <= 0 {
+		return &frameError{"invalid", "id must be positive"}
+	}
+	select {
+	case c.room.reads <- readSignal{from: c, id: p.ID}:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// markRead는 읽음 표시를 저장하고 방 전체에 receipt를, 그 사용자의 클라이언트(탭)에는 새 unread 수를 보낸다.
+// run 루프 안에서만 호출해야 한다.
+func (r *room) markRead(c *client, id int64) {
+	if r.store == nil || c.userID() == "" {
+		return
+	}
+	before, _, _ := r.store.Unread(r.name, c.userID())
+	if err := r.store.MarkRead(r.name, c.userID(), id); err != nil {
+		r.tracer.Trace("Failed to store read receipt: ", err)
+		return
+	}
+	lastRead, _, _ := r.store.Unread(r.name, c.userID())
+	if lastRead == before { // 이미 더 뒤까지 읽었다.
+		return
+	}
+	r.broadcast(newEnvelope(typeReceipt, receiptPayload{UserID: c.userID(), Name: c.name(), ID: lastRead}))
+	r.sendUnread(c.userID())
+}
+
+// sendUnread는 userID 사용자의 모든 클라이언트에게 읽지 않은 메시지 수를 보낸다.
+func (r *room) sendUnread(userID string) {
+	env, ok := r.unreadEnvelope(userID)
+	if !ok {
+		return
+	}
+	for c := range r.clients {
+		if c.userID() == userID {
+			r.sendTo(c, env)
+		}
+	}
+}
+
+func (r *room) unreadEnvelope(userID string) (*envelope, bool) {
+	lastRead, count, err := r.store.Unread(r.name, userID)
+	if err != nil {
+		r.tracer.Trace("Failed to count unread messages: ", err)
+		return nil, false
+	}
+	return newEnvelope(typeUnread, unreadPayload{Room: r.name, LastRead: lastRead, Unread: count}), true
+}
+
+// sendReadState는 새로 들어온 클라이언트에게 모든 사용자의 receipt와 자신의 unread 수를 보낸다.
+func (r *room) sendReadState(c *client) {
+	if r.store == nil {
+		return
+	}
+	receipts, err := r.store.Receipts(r.name)
+	if err != nil {
+		r.tracer.Trace("Failed to load read receipts: ", err)
+		return
+	}
+	p := receiptsPayload{Receipts: make([]receiptPayload, 0, len(receipts))}
+	for userID, id := range receipts {
+		p.Receipts = append(p.Receipts, receiptPayload{UserID: userID, Name: r.memberName(userID), ID: id})
+	}
+	r.sendTo(c, newEnvelope(typeReceipts, p))
+	if env, ok := r.unreadEnvelope(c.userID()); ok {
+		r.sendTo(c, env)
+	}
+}
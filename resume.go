@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resumeBacklogSize는 다시 연결한 클라이언트에게 다시 보내주기 위해 방이 보관하는 최근 이벤트 수이다.
+// 이보다 많이 놓쳤으면 클라이언트는 처음부터 다시 받아야 한다.(send 버퍼보다 작아야 한 번에 보낼 수 있다.)
+const resumeBacklogSize = 128
+
+// sessionPayload는 클라이언트가 방에 들어올 때 가장 먼저 받는 session envelope의 payload이다.
+// Resumed가 false이면 클라이언트는 화면을 비우고 뒤이어 오는 기록과 목록으로 다시 그려야 한다.
+type sessionPayload struct {
+	Epoch   string `json:"epoch"`   // 방이 만들어질 때 정해지는 값(방이 다시 만들어지면 seq도 처음부터 다시 센다.)
+	Seq     uint64 `json:"seq"`     // 지금까지 방에서 보낸 마지막 seq
+	Resumed bool   `json:"resumed"` // 놓친 이벤트만 이어서 보내는지
+}
+
+// resumePoint는 다시 연결한 클라이언트가 마지막으로 받은 위치이다.
+type resumePoint struct {
+	epoch string
+	seq   uint64
+}
+
+// parseResumePoint는 ?epoch={epoch}&seq={seq} 쿼리 파라미터를 읽는다. 없거나 잘못됐으면 nil을 리턴한다.
+// 쿼리가 없으면 SSE가 다시 연결할 때 보내는 Last-Event-ID 헤더({epoch}:{seq}, sseEventID 참고)를 읽는다.
+func parseResumePoint(req *http.Request) *resumePoint {
+	values := req.URL.Query()
+	epoch, seqText := values.Get("epoch"), values.Get("seq")
+	if epoch == "" && seqText == "" {
+		if parts := strings.SplitN(req.Header.Get("Last-Event-ID"), ":", 2); len(parts) == 2 {
+			epoch, seqText = parts[0], parts[1]
+		}
+	}
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if epoch == "" || err != nil {
+		return nil
+	}
+	return &resumePoint{epoch: epoch, seq: seq}
+}
+
+// sseEventID는 SSE 이벤트의 id이다. 브라우저가 다시 연결할 때 Last-Event-ID로 돌려보내므로 방의 epoch도 넣는다.
+func sseEventID(epoch string, seq uint64) string {
+	return epoch + ":" + strconv.FormatUint(seq, 10)
+}
+
+// newEpoch는 방의 epoch 값을 만든다.
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// publish는 env에 다음 seq를 붙여 방 전체에 보내고, 다시 연결하는 클라이언트를 위해 보관한다.
+// 나중에 다시 보내줄 가치가 있는 이벤트(메시지, 수정, 반응)에 사용한다.
+// 입장, 퇴장, 입력 중, 읽음 표시는 다시 연결할 때 전체 상태를 새로 보내므로 broadcast를 사용한다. run 루프 안에서만 호출해야 한다.
+func (r *room) publish(env *envelope) {
+	r.record(env)
+	r.broadcast(env)
+}
+
+// record는 env에 다음 seq를 붙여 다시 연결하는 클라이언트를 위해 보관만 한다.(스레드 답글처럼 일부에게만 보내는 이벤트)
+// run 루프 안에서만 호출해야 한다.
+func (r *room) record(env *envelope) {
+	r.seq++
+	env.Seq = r.seq
+	if len(r.backlog) == resumeBacklogSize {
+		copy(r.backlog, r.backlog[1:])
+		r.backlog = r.backlog[:len(r.backlog)-1]
+	}
+	r.backlog = append(r.backlog, env)
+}
+
+// missed는 p 이후에 방에서 보낸 이벤트를 리턴한다. 이어서 보낼 수 없으면(방이 바뀌었거나 너무 오래됨) false를 리턴한다.
+func (r *room) missed(p *resumePoint) ([]*envelope, bool) {
+	if p == nil || p.epoch != r.epoch || p.seq > r.seq {
+		return nil, false
+	}
+	n := r.seq - p.seq
+	if n > uint64(len(r.backlog)) {
+		return nil, false
+	}
+	return r.backlog[uint64(len(r.backlog))-n:], true
+}
+
+// welcome은 방에 들어온 클라이언트에게 처음 보내는 것들을 보낸다.
+// 다시 연결한 클라이언트가 놓친 이벤트를 이어서 받을 수 있으면 그것만 보내고, 아니면 최근 기록부터 다시 보낸다.
+// run 루프 안에서만 호출해야 한다.
+func (r *room) welcome(c *client) {
+	events, ok := r.missed(c.resume)
+	r.sendTo(c, newEnvelope(typeSession, sessionPayload{Epoch: r.epoch, Seq: r.seq, Resumed: ok}))
+	r.joined(c)
+	r.sendTopic(c)
+	if ok {
+		for _, env := range events {
+			r.sendTo(c, env)
+		}
+	} else {
+		r.replay(c)
+	}
+	r.sendReadState(c)
+}
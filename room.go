@@ -1,84 +1,445 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/soosungp33/Go_Chat/trace"
-	"github.com/stretchr/objx"
 )
 
 type room struct {
+	name    string        // name은 /room/{name}에서 사용하는 방 이름
 	forward chan *message // forward는 수신 메시지를 보관하는 채널이며 수신한 메시지는 다른 클라이언트로 전달돼야 한다
 	// join과 leave는 clients 맵에서 클라이언트를 안전하게 추가 및 제거하기 위해 존재
-	join    chan *client     // 방에 들어오려는 클라이언트를 위한 채널
-	leave   chan *client     // 방을 나가길 원하는 클라이언트를 위한 채널
-	clients map[*client]bool // 현재 채팅방에 있는 모든 클라이언트를 보유
-	tracer  trace.Tracer     // tracer는 방 안에서 활동의 추적 정보를 수신한다.
+	join     chan *client               // 방에 들어오려는 클라이언트를 위한 채널
+	leave    chan *client               // 방을 나가길 원하는 클라이언트를 위한 채널
+	direct   chan *delivery             // 한 클라이언트에게만 보낼 envelope(에러 등)를 위한 채널
+	typing   chan typingSignal          // 입력 중 상태 변경을 위한 채널
+	reads    chan readSignal            // 읽음 표시를 위한 채널
+	edits    chan editSignal            // 메시지 수정/삭제 요청을 위한 채널
+	reacts   chan reactSignal           // 이모지 반응 추가/취소를 위한 채널
+	threads  chan threadSignal          // 스레드 구독/구독 해제를 위한 채널
+	commands chan *commandContext       // /로 시작하는 채팅 명령을 실행하기 위한 채널
+	notices  chan *notice               // 다른 방이나 DM에서 이 방의 특정 사용자에게 보내는 envelope(버퍼가 있어 기다리지 않음)
+	sentKeys map[string]sentKey         // 사용자와 key별로 최근에 처리한 메시지(중복 전송 확인)
+	typists  map[string]time.Time       // 입력 중인 사용자(userid)와 입력 상태가 끝나는 시각
+	clients  map[*client]bool           // 현재 채팅방에 있는 모든 클라이언트를 보유
+	watchers map[int64]map[*client]bool // 스레드(첫 메시지 ID)별로 구독 중인 클라이언트
+	members  map[string]*member         // userid별 접속 중인 사용자(presence)
+	tracer   trace.Tracer               // tracer는 방 안에서 활동의 추적 정보를 수신한다.
+
+	store       MessageStore       // store는 방의 메시지 기록을 보관한다.(nil이면 기록하지 않음)
+	historySize int                // 새 클라이언트에게 다시 보내줄 최근 메시지 수
+	editWindow  time.Duration      // 작성자가 자기 메시지를 수정/삭제할 수 있는 시간(0이면 제한 없음)
+	moderators  map[string]bool    // 어떤 메시지든 지울 수 있는 사용자(userid)
+	announcers  map[string]bool    // 모더레이터 말고도 @here, @room을 쓸 수 있는 사용자(userid)
+	settings    *settingsStore     // 주제, 닉네임 등 방의 설정(nil이면 /topic, /nick을 쓸 수 없음)
+	overflow    overflowPolicy     // send 버퍼가 가득 찬 클라이언트를 처리하는 방법
+	dropped     uint64             // overflow 정책 때문에 버려진 메시지 수(atomic으로 접근)
+	evicted     uint64             // overflow 정책 때문에 연결이 끊긴 클라이언트 수(atomic으로 접근)
+	epoch       string             // 방이 만들어질 때 정해지는 값(다시 연결한 클라이언트가 같은 방인지 확인)
+	seq         uint64             // 마지막으로 publish한 이벤트의 seq
+	backlog     []*envelope        // 최근에 publish한 이벤트(최대 resumeBacklogSize개)
+	idleTimeout time.Duration      // 클라이언트가 모두 나간 뒤 방을 정리하기까지 기다리는 시간(0이면 정리하지 않음)
+	unusedTTL   time.Duration      // idleTimeout이 0이어도 아무도 들어오지 않은 방을 정리하기까지 기다리는 시간(0이면 정리하지 않음)
+	registry    *roomRegistry      // 방이 정리될 때 알려줄 레지스트리(없으면 nil)
+	hooks       *webhookDispatcher // 새 메시지와 입장/퇴장을 웹훅으로 보낸다.(nil이면 보내지 않음)
+	done        chan struct{}      // run 루프가 끝나면 닫힌다.
+	quit        chan struct{}      // 닫히면 run 루프가 모든 클라이언트를 내보내고 끝난다.(서버 종료)
+	quitOnce    sync.Once          // quit 채널을 한 번만 닫기 위해 사용
+	wg          sync.WaitGroup     // 방에 들어온 클라이언트의 read/write 고루틴이 끝날 때까지 기다리기 위해 사용
 }
 
-func newRoom() *room { // 채팅방 만드는 함수
+func newRoom(name string) *room { // 채팅방 만드는 함수
 	return &room{
-		forward: make(chan *message),
-		join:    make(chan *client),
-		leave:   make(chan *client),
-		clients: make(map[*client]bool),
-		tracer:  trace.Off(),
+		name:     name,
+		epoch:    newEpoch(),
+		forward:  make(chan *message),
+		join:     make(chan *client),
+		leave:    make(chan *client),
+		direct:   make(chan *delivery),
+		typing:   make(chan typingSignal),
+		reads:    make(chan readSignal),
+		edits:    make(chan editSignal),
+		reacts:   make(chan reactSignal),
+		threads:  make(chan threadSignal),
+		commands: make(chan *commandContext),
+		watchers: make(map[int64]map[*client]bool),
+		notices:  make(chan *notice, noticeBufferSize),
+		sentKeys: make(map[string]sentKey),
+		typists:  make(map[string]time.Time),
+		clients:  make(map[*client]bool),
+		members:  make(map[string]*member),
+		tracer:   trace.Off(),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+}
+
+// delivery는 특정 클라이언트에게만 보낼 envelope이다.
+type delivery struct {
+	to  *client
+	env *envelope
+}
+
+// notice는 특정 사용자(userid)의 모든 클라이언트에게 보낼 envelope이다.
+type notice struct {
+	userID string
+	env    *envelope
+}
+
+const noticeBufferSize = 64
+
+// notify는 이 방에 있는 userID 사용자의 클라이언트에게 env를 보낸다.
+// 다른 방의 run 루프에서 호출될 수 있으므로 기다리지 않고, 버퍼가 가득 차면 버린다.
+func (r *room) notify(userID string, env *envelope) {
+	select {
+	case r.notices <- &notice{userID: userID, env: env}:
+	default:
+		r.tracer.Trace("Notice dropped for ", userID)
+	}
+}
+
+// reply는 c에게만 env를 보낸다. c의 send 채널은 run 루프만 다루므로 direct 채널을 거친다.
+// 방이 이미 끝났으면 false를 리턴한다.
+func (r *room) reply(c *client, env *envelope) bool {
+	select {
+	case r.direct <- &delivery{to: c, env: env}:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// shutdown은 run 루프에 종료를 알린다. 클라이언트는 going-away close 프레임을 받고 연결이 끊긴다.
+func (r *room) shutdown() {
+	r.quitOnce.Do(func() { close(r.quit) })
+}
+
+// enter는 클라이언트를 방에 넣는다. 방이 이미 정리돼 run 루프가 끝났다면 false를 리턴한다.
+func (r *room) enter(c *client) bool {
+	select {
+	case r.join <- c:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// exit는 클라이언트를 방에서 뺀다. run 루프가 끝난 방이면 기다리지 않는다.
+func (r *room) exit(c *client) {
+	select {
+	case r.leave <- c:
+	case <-r.done:
 	}
 }
 
 func (r *room) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(time.Second) // 입력 중 상태가 끝났는지 확인하는 주기
+	defer ticker.Stop()
+	var idle <-chan time.Time // 방이 비어있을 때만 동작하는 타이머 채널(nil 채널은 영원히 대기)
+	joined := false           // 클라이언트가 한 번이라도 들어왔는지
 	for {
+		if len(r.clients) == 0 && idle == nil { // 방이 비면 정리 타이머를 시작
+			if r.idleTimeout > 0 {
+				idle = time.After(r.idleTimeout)
+			} else if !joined && r.unusedTTL > 0 { // 정리하지 않는 설정이어도 아무도 들어오지 않은 방은 남기지 않는다.
+				idle = time.After(r.unusedTTL)
+			}
+		}
 		select { // 한 번에 한 케이스 코드만 실행되므로 맵이 동시에 여러 개 수정되는 가능성을 방지하며 동기화한다.
 		case client := <-r.join: // join 채널에서 메시지를 받으면
 			// 입장
 			r.clients[client] = true
+			joined = true
+			r.wg.Add(2) // read, write 고루틴(run 루프가 끝나기 전에 더해야 shutdown에서 Wait할 수 있다.)
+			idle = nil
 			r.tracer.Trace("New client joined")
+			if sn, banned := r.sanctioned(sanctionBan, client.userID()); banned { // authorize 뒤에 ban된 경우
+				client.closeCode = closeBanned
+				client.closeText = "banned " + sn.describe()
+				r.remove(client)
+				break
+			}
+			r.welcome(client)
 		case client := <-r.leave: // leave 채널에서 메시지를 받으면
 			// 퇴장
-			delete(r.clients, client)
-			close(client.send)
-			r.tracer.Trace("Client left")
+			if r.clients[client] { // overflow 정책으로 이미 내보낸 클라이언트일 수 있다.
+				r.remove(client)
+				r.tracer.Trace("Client left")
+			}
+		case <-idle: // 빈 상태로 idleTimeout(아무도 들어오지 않았다면 unusedTTL)이 지나면 방을 정리
+			if r.registry != nil {
+				r.registry.remove(r)
+			}
+			r.tracer.Trace("Room closed: ", r.name)
+			return
+		case <-r.quit: // 서버 종료: 모든 클라이언트에게 going-away를 보내고 끝낸다.
+			for client := range r.clients { // 모두 나가므로 leave 이벤트는 보내지 않는다.
+				client.closeCode = websocket.CloseGoingAway
+				client.closeText = "server shutting down"
+				delete(r.clients, client)
+				close(client.send)
+			}
+			r.tracer.Trace("Room shut down: ", r.name)
+			return
 		case msg := <-r.forward: // forward 채널에서 메시지를 받으면
 			// 모든 클라이언트에게 메시지 전달
 			r.tracer.Trace("Message received: ", string(msg.Message))
+			r.accept(msg)
+		case ctx := <-r.commands: // 채팅 명령
+			if r.clients[ctx.client] {
+				r.runCommand(ctx)
+			}
+		case sig := <-r.reacts: // 이모지 반응
+			if r.clients[sig.from] {
+				r.applyReact(sig)
+			}
+		case sig := <-r.threads: // 스레드 구독/구독 해제
+			if r.clients[sig.from] {
+				r.watch(sig.from, sig.id, sig.on)
+			}
+		case sig := <-r.typing: // 입력 중 상태 변경
+			if r.clients[sig.from] {
+				r.setTyping(sig.from, sig.active)
+			}
+		case sig := <-r.reads: // 읽음 표시
+			if r.clients[sig.from] {
+				r.markRead(sig.from, sig.id)
+			}
+		case sig := <-r.edits: // 메시지 수정/삭제
+			if r.clients[sig.from] {
+				r.applyEdit(sig)
+			}
+		case now := <-ticker.C:
+			r.expireTyping(now)
+			r.expireSentKeys(now)
+		case n := <-r.notices: // 특정 사용자에게 보내는 envelope
 			for client := range r.clients {
-				client.send <- msg // 각 클라이언트의 send 채널에 메시지를 추가하고 클라이언트 타입의 write 메소드가 이를 받아들여 소켓에서 브라우저로 보낸다.
-				r.tracer.Trace(" -- set to client")
+				if client.userID() == n.userID {
+					r.sendTo(client, n.env)
+				}
+			}
+		case d := <-r.direct: // 한 클라이언트에게만 보내는 envelope
+			if r.clients[d.to] {
+				r.sendTo(d.to, d.env)
 			}
 		}
 	}
 }
 
+// accept는 새 메시지를 기록하고 방에 보낸다. run 루프 안에서만 호출해야 한다.
+func (r *room) accept(msg *message) {
+	if r.duplicate(msg) { // 클라이언트가 다시 보낸 메시지는 한 번만 처리한다.
+		return
+	}
+	if _, ok := r.typists[msg.UserID]; ok && msg.UserID != "" { // 메시지를 보냈으면 입력 중 상태는 끝난다.
+		delete(r.typists, msg.UserID)
+	}
+	if nick := r.nick(msg.UserID); nick != "" { // /nick으로 정한 이름으로 보인다.
+		msg.Name = nick
+	}
+	if r.store != nil {
+		if err := r.store.Append(r.name, msg); err != nil { // 전달하기 전에 기록을 남긴다.
+			r.tracer.Trace("Failed to store message: ", err)
+		}
+	}
+	if msg.ParentID != 0 { // 스레드 답글은 방 전체가 아니라 구독자에게만 보낸다.
+		r.postReply(msg)
+	} else {
+		r.publish(newEnvelope(typeChat, msg))
+	}
+	r.acknowledge(msg)
+	r.notifyMentions(msg)
+	r.hook(hookMessage, webhookEvent{Message: msg})
+}
+
+// remove는 클라이언트를 clients 맵에서 빼고 send 채널을 닫아 write 고루틴을 끝낸다.
+func (r *room) remove(c *client) {
+	delete(r.clients, c)
+	r.unwatchAll(c)
+	close(c.send)
+	r.left(c)
+}
+
+// overflowPolicy는 send 버퍼가 가득 찬(느린) 클라이언트에게 메시지를 보낼 때의 처리 방법이다.
+type overflowPolicy int
+
 const (
-	socketBufferSize  = 1024
-	messageBufferSize = 256
+	dropOldest     overflowPolicy = iota // 가장 오래된 대기 메시지를 버리고 새 메시지를 넣는다.
+	dropNewest                           // 새 메시지를 버린다.
+	disconnectSlow                       // 클라이언트에게 close 프레임을 보내고 연결을 끊는다.
+)
+
+var overflowPolicyNames = map[string]overflowPolicy{
+	"drop-oldest": dropOldest,
+	"drop-newest": dropNewest,
+	"disconnect":  disconnectSlow,
+}
+
+// parseOverflowPolicy는 -overflow 플래그 값을 overflowPolicy로 바꾼다.
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	if p, ok := overflowPolicyNames[s]; ok {
+		return p, nil
+	}
+	return dropOldest, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// broadcast는 방의 모든 클라이언트에게 envelope를 전달한다.
+func (r *room) broadcast(env *envelope) {
+	for client := range r.clients {
+		r.sendTo(client, env)
+	}
+}
+
+// sendTo는 한 클라이언트의 send 채널에 envelope를 넣는다.
+// send 채널에 바로 넣을 수 없는 클라이언트는 기다리지 않고 overflow 정책에 따라 처리하므로, 느린 클라이언트 하나 때문에 방 전체가 멈추지 않는다.
+func (r *room) sendTo(c *client, env *envelope) {
+	select {
+	case c.send <- env: // 각 클라이언트의 send 채널에 메시지를 추가하고 클라이언트 타입의 write 메소드가 이를 받아들여 소켓에서 브라우저로 보낸다.
+		r.tracer.Trace(" -- set to client")
+	default:
+		r.overflowed(c, env)
+	}
+}
+
+// overflowed는 send 버퍼가 가득 찬 클라이언트를 overflow 정책에 따라 처리한다. run 루프 안에서만 호출해야 한다.
+func (r *room) overflowed(c *client, env *envelope) {
+	switch r.overflow {
+	case dropOldest:
+		select {
+		case <-c.send: // 가장 오래된 메시지를 꺼내 버린다.(그 사이 write 고루틴이 먼저 꺼냈을 수도 있다.)
+		default:
+		}
+		select {
+		case c.send <- env:
+		default:
+		}
+		n := atomic.AddUint64(&r.dropped, 1)
+		r.tracer.Trace(" -- slow client, dropped oldest message (total dropped: ", n, ")")
+	case dropNewest:
+		n := atomic.AddUint64(&r.dropped, 1)
+		r.tracer.Trace(" -- slow client, dropped newest message (total dropped: ", n, ")")
+	case disconnectSlow:
+		c.closeCode = websocket.ClosePolicyViolation // write 고루틴이 send 채널이 닫힌 것을 보고 close 프레임을 보낸다.
+		c.closeText = "client too slow"
+		r.remove(c)
+		n := atomic.AddUint64(&r.evicted, 1)
+		r.tracer.Trace(" -- slow client disconnected (total evicted: ", n, ")")
+	}
+}
+
+// replay는 새로 들어온 클라이언트의 send 채널에 최근 메시지를 먼저 넣어준다.
+// run 루프 안에서 호출되므로 이후의 실시간 메시지보다 항상 앞에 온다.
+func (r *room) replay(c *client) {
+	if r.store == nil || r.historySize <= 0 {
+		return
+	}
+	// send 채널의 남은 자리보다 많이 넣으면 run 루프가 막히므로 제한한다.
+	// welcome이 먼저 넣은 session, roster, topic과 뒤에 넣을 읽음 상태(receipts, unread)의 자리를 뺀다.
+	limit := r.historySize
+	if free := cap(c.send) - len(c.send) - readStateEnvelopes; limit > free {
+		limit = free
+	}
+	if limit <= 0 {
+		return
+	}
+	msgs, err := r.store.Query(r.name, historyQuery{Limit: limit})
+	if err != nil {
+		r.tracer.Trace("Failed to load history: ", err)
+		return
+	}
+	for _, msg := range msgs {
+		r.sendTo(c, newEnvelope(typeChat, msg)) // 그래도 가득 차면 overflow 정책을 따른다.(기다리지 않음)
+	}
+}
+
+const (
+	socketBufferSize   = 1024
+	messageBufferSize  = 256
+	readStateEnvelopes = 2 // sendReadState가 보내는 envelope 수(receipts, unread)
 )
 
 // 웹 소켓을 사용하려면 websocket.Upgrader 타입을 사용해 HTTP 연결을 업그레이드 해야 한다.(재사용 가능)
-var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize}
+// Subprotocols는 서버가 우선하는 순서이며, 클라이언트가 아무것도 보내지 않으면 협상하지 않고 JSON을 사용한다.
+var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize, Subprotocols: subprotocols()}
 
 func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) { // 사용자 데이터는 http.Request 객체의 Cookie 메소드를 통해 액세스하는 클라이언트 쿠키에서 가져온다.
-	socket, err := upgrader.Upgrade(w, req, nil) // 소켓 가져오기
-	if err != nil {
-		log.Fatal("ServeHTTP: ", err)
+	userData, ok := r.authorize(w, req)
+	if !ok {
 		return
 	}
-	authCookie, err := req.Cookie("auth") // 클라이언트에 전달하기 전에 사용자 데이터를 가져온다.
+	socket, err := upgrader.Upgrade(w, req, nil) // 소켓 가져오기
 	if err != nil {
-		log.Fatal("Failed to get auth cookie:", err)
+		log.Println("ServeHTTP: ", err) // Upgrade가 이미 에러 응답을 보냈다.
 		return
 	}
 
 	client := &client{ //  문제가 없다면 클라이언트 생성
 		socket:   socket,
-		send:     make(chan *message, messageBufferSize),
+		send:     make(chan *envelope, messageBufferSize),
 		room:     r,
-		userData: objx.MustFromBase64(authCookie.Value), // objx.MustFromBase64를 통해 인코딩된 쿠키 값을 사용가능한 맵 객체로 변환
+		codec:    codecFor(socket.Subprotocol()),
+		userData: userData, // objx.Map은 map[string]interface{}이다.
+		resume:   parseResumePoint(req),
+	}
+	joined := r.admit(client)
+	if joined == nil {
+		socket.Close()
+		return
+	}
+	defer func() {
+		joined.exit(client)
+		joined.wg.Done()
+	}()
+	go func() { // 고루틴으로 클라이언트의 write 메소드를 호출
+		client.write()
+		joined.wg.Done()
+	}()
+	client.read() // 메인 스레드에서 read 메소드를 호출해 닫을 때까지 작업을 차단(연결을 활성 상태로 유지)
+}
+
+// authorize는 요청의 auth 쿠키에서 사용자 정보를 꺼내고 사용자 목록에 기록한다.
+// 웹 소켓이든 다른 전송 방식(SSE, long-polling)이든 방에 들어오기 전에 호출하며, 실패하면 에러 응답을 보내고 false를 리턴한다.
+func (r *room) authorize(w http.ResponseWriter, req *http.Request) (map[string]interface{}, bool) {
+	if r.registry != nil && r.registry.isClosed() { // 서버가 종료 중이면 새 연결을 받지 않는다.
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	userData, err := authUserData(req) // 클라이언트에 전달하기 전에 사용자 데이터를 가져온다.
+	if err != nil {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return nil, false
+	}
+	if r.refuseBanned(w, userData.Get("userid").Str()) { // ban된 사용자는 다시 들어올 수 없다.
+		return nil, false
+	}
+	if r.registry != nil && r.registry.users != nil { // DM 상대를 찾을 수 있도록 사용자 정보를 기록
+		p := profile{ID: userData.Get("userid").Str(), Name: userData.Get("name").Str(), AuthAvatar: userData.Get("avatar_url").Str()}
+		if err := r.registry.users.remember(p); err != nil {
+			log.Println("Failed to remember user:", err)
+		}
+	}
+	return userData, true
+}
+
+// admit는 c를 방에 들여보내고 실제로 들어간 방을 리턴한다.(들어가지 못하면 nil)
+// 방이 정리되는 중이었다면 레지스트리에서 새 방을 받아 다시 들어간다.(서버 종료 중이면 get이 nil을 리턴)
+// 들어간 방의 wg에 2가 더해지므로, 클라이언트가 끝날 때 wg.Done을 두 번 호출해야 한다.
+func (r *room) admit(c *client) *room {
+	for !c.room.enter(c) { // 생성한 클라이언트를 join채널에 전달
+		if r.registry == nil {
+			return nil
+		}
+		if c.room = r.registry.get(r.name); c.room == nil {
+			return nil
+		}
 	}
-	r.join <- client // 생성한 클라이언트를 join채널에 전달
-	defer func() { r.leave <- client }()
-	go client.write() // 고루틴으로 클라이언트의 write 메소드를 호출
-	client.read()     // 메인 스레드에서 read 메소드를 호출해 닫을 때까지 작업을 차단(연결을 활성 상태로 유지)
+	return c.room
 }
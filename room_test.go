@@ -0,0 +1,487 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient는 소켓 없이 send 버퍼 크기만 정한 클라이언트를 만들어 방에 넣는다.
+func newTestClient(r *room, buffer int) *client {
+	c := &client{send: make(chan *envelope, buffer), room: r}
+	r.clients[c] = true
+	return c
+}
+
+// newUserTestClient는 userid, name 사용자의 클라이언트를 만들어 방에 넣는다.(presence는 바꾸지 않는다.)
+func newUserTestClient(r *room, buffer int, userid, name string) *client {
+	c := newTestClient(r, buffer)
+	c.userData = map[string]interface{}{"userid": userid, "name": name}
+	return c
+}
+
+// joinTestClient는 userid, name 사용자의 클라이언트를 만들어 방에 넣고 presence를 갱신한다.(run 루프 없이 사용)
+func joinTestClient(r *room, buffer int, userid, name string) *client {
+	c := newUserTestClient(r, buffer, userid, name)
+	r.joined(c)
+	return c
+}
+
+// runTestCommand는 c가 보낸 text 명령을 run 루프 없이 실행한다. 명령을 해석하지 못하면 에러를 리턴한다.
+func runTestCommand(c *client, text string) error {
+	ctx, err := c.newCommandContext(chatPayload{Message: text})
+	if err != nil {
+		return err
+	}
+	c.room.runCommand(ctx)
+	return nil
+}
+
+func TestRoomBroadcastDropOldest(t *testing.T) {
+	r := newRoom("dev")
+	r.overflow = dropOldest
+	slow := newTestClient(r, 2)
+	fast := newTestClient(r, 10)
+
+	for _, text := range []string{"1", "2", "3"} {
+		r.broadcast(newEnvelope(typeChat, &message{Message: text}))
+	}
+	if got := chatText(<-slow.send) + chatText(<-slow.send); got != "23" {
+		t.Errorf("slow client should keep the newest messages, got %s", got)
+	}
+	if len(fast.send) != 3 {
+		t.Errorf("fast client should receive every message, got %d", len(fast.send))
+	}
+	if r.dropped != 1 {
+		t.Errorf("room should count 1 dropped message, got %d", r.dropped)
+	}
+}
+
+func TestRoomBroadcastDropNewest(t *testing.T) {
+	r := newRoom("dev")
+	r.overflow = dropNewest
+	slow := newTestClient(r, 2)
+
+	for _, text := range []string{"1", "2", "3"} {
+		r.broadcast(newEnvelope(typeChat, &message{Message: text}))
+	}
+	if got := chatText(<-slow.send) + chatText(<-slow.send); got != "12" {
+		t.Errorf("slow client should keep the oldest messages, got %s", got)
+	}
+	if r.dropped != 1 {
+		t.Errorf("room should count 1 dropped message, got %d", r.dropped)
+	}
+}
+
+func TestRoomBroadcastDisconnect(t *testing.T) {
+	r := newRoom("dev")
+	r.overflow = disconnectSlow
+	slow := newTestClient(r, 1)
+
+	r.broadcast(newEnvelope(typeChat, &message{Message: "1"}))
+	r.broadcast(newEnvelope(typeChat, &message{Message: "2"}))
+	if r.clients[slow] {
+		t.Error("slow client should be removed from the room")
+	}
+	if slow.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("slow client should be closed with ClosePolicyViolation, got %d", slow.closeCode)
+	}
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Error("slow client's send channel should be closed")
+	}
+	if r.evicted != 1 {
+		t.Errorf("room should count 1 evicted client, got %d", r.evicted)
+	}
+}
+
+func chatText(env *envelope) string {
+	return env.Payload.(*message).Message
+}
+
+func TestRoomPresence(t *testing.T) {
+	r := newRoom("dev")
+	join := func(userid, name string) *client { return joinTestClient(r, 10, userid, name) }
+	alice := join("a", "alice")
+	tab1 := join("b", "bob")
+	tab2 := join("b", "bob") // 같은 사용자의 두 번째 탭
+
+	if env := <-tab2.send; env.Type != typeRoster || len(env.Payload.(rosterPayload).Members) != 2 {
+		t.Errorf("new client should receive a roster with 2 members, got %+v", env)
+	}
+	<-alice.send // roster
+	if env := <-alice.send; env.Type != typeJoin || env.Payload.(member).UserID != "b" {
+		t.Errorf("alice should be told bob joined, got %+v", env)
+	}
+	if len(alice.send) != 0 {
+		t.Error("a second tab of the same user should not broadcast another join")
+	}
+
+	r.remove(tab1)
+	if len(alice.send) != 0 {
+		t.Error("closing one of two tabs should not broadcast leave")
+	}
+	r.remove(tab2)
+	if env := <-alice.send; env.Type != typeLeave || env.Payload.(member).UserID != "b" {
+		t.Errorf("alice should be told bob left, got %+v", env)
+	}
+	if len(r.members) != 1 {
+		t.Errorf("room should have 1 member left, got %d", len(r.members))
+	}
+}
+
+func TestRoomTyping(t *testing.T) {
+	r := newRoom("dev")
+	alice := newUserTestClient(r, 10, "a", "alice")
+	bob := newUserTestClient(r, 10, "b", "bob")
+
+	r.setTyping(alice, true)
+	if len(alice.send) != 0 {
+		t.Error("typing should not be echoed to the typist")
+	}
+	if env := <-bob.send; env.Type != typeTyping || !env.Payload.(typingPayload).Active {
+		t.Errorf("bob should be told alice is typing, got %+v", env)
+	}
+
+	r.expireTyping(time.Now()) // 아직 typingTimeout이 지나지 않음
+	if len(bob.send) != 0 {
+		t.Error("typing should not expire before typingTimeout")
+	}
+	r.expireTyping(time.Now().Add(typingTimeout + time.Second))
+	if env := <-bob.send; env.Type != typeTyping || env.Payload.(typingPayload).Active {
+		t.Errorf("bob should be told alice stopped typing, got %+v", env)
+	}
+	if len(r.typists) != 0 {
+		t.Error("expired typists should be removed")
+	}
+}
+
+func TestRoomEditPermissions(t *testing.T) {
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	r.editWindow = time.Minute
+	r.moderators = map[string]bool{"m": true}
+	alice := newUserTestClient(r, 10, "a", "alice")
+	bob := newUserTestClient(r, 10, "b", "bob")
+	mod := newUserTestClient(r, 10, "m", "mod")
+	r.store.Append("dev", &message{UserID: "a", Message: "hello", When: time.Now()})
+	r.store.Append("dev", &message{UserID: "a", Message: "old", When: time.Now().Add(-time.Hour)})
+
+	expectError := func(c *client, code string) {
+		t.Helper()
+		env := <-c.send
+		if p, ok := env.Payload.(errorPayload); env.Type != typeError || !ok || p.Code != code {
+			t.Errorf("expected %s error, got %+v", code, env)
+		}
+	}
+	expectUpdate := func(deleted bool) {
+		t.Helper()
+		for _, c := range []*client{alice, bob, mod} {
+			env := <-c.send
+			if msg, ok := env.Payload.(*message); env.Type != typeUpdate || !ok || msg.Deleted != deleted {
+				t.Errorf("expected update (deleted=%v), got %+v", deleted, env)
+			}
+		}
+	}
+
+	r.applyEdit(editSignal{from: bob, id: 1, text: "hijacked"})
+	expectError(bob, "forbidden")
+	r.applyEdit(editSignal{from: alice, id: 2, text: "too late"})
+	expectError(alice, "forbidden")
+	r.applyEdit(editSignal{from: alice, id: 3, text: "missing"})
+	expectError(alice, "not_found")
+
+	r.applyEdit(editSignal{from: alice, id: 1, text: "hello!"})
+	expectUpdate(false)
+	r.applyEdit(editSignal{from: mod, id: 2, deleted: true}) // 모더레이터는 editWindow와 상관없이 지울 수 있다.
+	expectUpdate(true)
+	r.applyEdit(editSignal{from: alice, id: 2, text: "again"})
+	expectError(alice, "invalid")
+}
+
+func TestRoomThreads(t *testing.T) {
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	alice := newUserTestClient(r, 10, "a", "alice")
+	bob := newUserTestClient(r, 10, "b", "bob")
+	carol := newUserTestClient(r, 10, "c", "carol")
+	r.store.Append("dev", &message{UserID: "a", Message: "root"})
+	r.watch(alice, 1, true)
+	before := r.seq
+
+	reply := &message{UserID: "b", Message: "reply", ParentID: 1}
+	r.store.Append("dev", reply)
+	r.postReply(reply)
+	for _, c := range []*client{alice, bob} { // 답글을 쓴 bob은 자동으로 구독한다.
+		if env := <-c.send; env.Type != typeReply {
+			t.Errorf("subscriber and author should get the reply first, got %+v", env)
+		}
+	}
+	for _, c := range []*client{alice, bob, carol} {
+		env := <-c.send
+		if msg, ok := env.Payload.(*message); env.Type != typeUpdate || !ok || msg.ID != 1 || msg.Replies != 1 {
+			t.Errorf("everyone should get the updated reply count, got %+v", env)
+		}
+	}
+	if len(carol.send) != 0 {
+		t.Error("replies should only go to subscribers")
+	}
+	if events, ok := r.missed(&resumePoint{epoch: r.epoch, seq: before}); !ok || len(events) != 2 || events[0].Type != typeReply {
+		t.Errorf("resuming clients should get the reply, got %d events", len(events))
+	}
+
+	r.remove(alice)
+	r.remove(bob)
+	if len(r.watchers) != 0 {
+		t.Errorf("leaving should drop subscriptions, got %v", r.watchers)
+	}
+}
+
+func TestRoomMentions(t *testing.T) {
+	r := newRoom("dev")
+	r.registry = newRoomRegistry(newRoom, 0)
+	r.registry.users, _ = newUserDirectory("")
+	r.registry.users.remember(profile{ID: "a", Name: "Alice Kim"})
+	r.registry.users.remember(profile{ID: "b", Name: "bob"})
+	r.moderators = map[string]bool{"m": true}
+	alice := newUserTestClient(r, 10, "a", "Alice Kim")
+	bob := newUserTestClient(r, 10, "b", "bob")
+	mod := newUserTestClient(r, 10, "m", "mod")
+
+	msg := &message{UserID: "b", Message: "hi @alicekim and @nobody, mail me at bob@example.com"}
+	if err := r.mentions(msg); err != nil || len(msg.Mentions) != 1 || msg.Mentions[0] != "a" {
+		t.Fatalf("mentions = %v, %v; want [a]", msg.Mentions, err)
+	}
+	if err := r.mentions(&message{UserID: "b", Message: "@here lunch?"}); err == nil {
+		t.Error("@here should need permission")
+	}
+	all := &message{UserID: "m", Message: "@here meeting"}
+	if err := r.mentions(all); err != nil || all.MentionAll != mentionHere {
+		t.Fatalf("moderators should be able to use @here, got %q, %v", all.MentionAll, err)
+	}
+
+	for _, c := range []*client{alice, bob, mod} {
+		r.members[c.userID()] = &member{UserID: c.userID(), conns: 1}
+	}
+	r.notifyMentions(all)
+	for _, c := range []*client{alice, bob} {
+		if env := <-c.send; env.Type != typeMention {
+			t.Errorf("%s should be notified, got %+v", c.name(), env)
+		}
+	}
+	if len(mod.send) != 0 {
+		t.Error("the sender should not be notified")
+	}
+}
+
+func TestRoomResume(t *testing.T) {
+	r := newRoom("dev")
+	for i := 0; i < resumeBacklogSize+10; i++ {
+		r.publish(newEnvelope(typeChat, &message{Message: "hi"}))
+	}
+	last := r.seq
+	if last != resumeBacklogSize+10 || len(r.backlog) != resumeBacklogSize {
+		t.Fatalf("seq = %d, backlog = %d; want %d, %d", last, len(r.backlog), resumeBacklogSize+10, resumeBacklogSize)
+	}
+
+	events, ok := r.missed(&resumePoint{epoch: r.epoch, seq: last - 3})
+	if !ok || len(events) != 3 || events[0].Seq != last-2 || events[2].Seq != last {
+		t.Errorf("missed should return the last 3 events, got %d (ok=%v)", len(events), ok)
+	}
+	if events, ok := r.missed(&resumePoint{epoch: r.epoch, seq: last}); !ok || len(events) != 0 {
+		t.Errorf("an up-to-date client should resume with nothing to replay, got %d (ok=%v)", len(events), ok)
+	}
+	for _, p := range []*resumePoint{
+		nil,
+		{epoch: "other", seq: last},     // 방이 다시 만들어짐
+		{epoch: r.epoch, seq: 1},        // 너무 오래됨
+		{epoch: r.epoch, seq: last + 1}, // 아직 없는 seq
+	} {
+		if _, ok := r.missed(p); ok {
+			t.Errorf("missed(%+v) should require a full resync", p)
+		}
+	}
+
+	c := newTestClient(r, messageBufferSize)
+	c.userData = map[string]interface{}{"userid": "a", "name": "alice"}
+	c.resume = &resumePoint{epoch: r.epoch, seq: last - 1}
+	r.welcome(c)
+	if env := <-c.send; env.Type != typeSession || !env.Payload.(sessionPayload).Resumed {
+		t.Errorf("welcome should start with a resumed session, got %+v", env)
+	}
+	<-c.send // roster
+	if env := <-c.send; env.Seq != last {
+		t.Errorf("welcome should replay the missed event, got %+v", env)
+	}
+}
+
+func TestRoomIdempotentSend(t *testing.T) {
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	alice := newUserTestClient(r, 10, "a", "alice")
+
+	first := &message{UserID: "a", Message: "hi", Key: "k1", When: time.Now()}
+	r.store.Append(r.name, first)
+	r.acknowledge(first)
+	if env := <-alice.send; env.Type != typeAck || env.Payload.(ackPayload).ID != first.ID {
+		t.Errorf("sender should get an ack with the message ID, got %+v", env)
+	}
+
+	if !r.duplicate(&message{UserID: "a", Message: "hi", Key: "k1"}) {
+		t.Fatal("a retry with the same key should be a duplicate")
+	}
+	if env := <-alice.send; env.Type != typeAck || !env.Payload.(ackPayload).Duplicate || env.Payload.(ackPayload).ID != first.ID {
+		t.Errorf("a duplicate should be acked with the original ID, got %+v", env)
+	}
+	if r.duplicate(&message{UserID: "b", Message: "hi", Key: "k1"}) {
+		t.Error("keys should be scoped to the sender")
+	}
+
+	r.expireSentKeys(time.Now().Add(dedupWindow + time.Second))
+	if r.duplicate(&message{UserID: "a", Message: "hi", Key: "k1"}) {
+		t.Error("keys should expire after dedupWindow")
+	}
+}
+
+func TestRoomReplayFitsSendBuffer(t *testing.T) {
+	r := newRoom("dev")
+	r.store = newMemoryStore()
+	r.historySize = 50
+	for i := 0; i < 20; i++ {
+		r.store.Append(r.name, &message{Message: "m"})
+	}
+	c := newTestClient(r, 8) // replay 수보다 작은 버퍼
+
+	done := make(chan struct{})
+	go func() {
+		r.welcome(c) // session, roster 다음에 replay, 읽음 상태가 온다.
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("welcome blocked on a client whose send buffer is smaller than the replay")
+	}
+	var types []string
+	for len(c.send) > 0 {
+		types = append(types, (<-c.send).Type)
+	}
+	if len(types) != 8 || types[len(types)-2] != typeReceipts || types[len(types)-1] != typeUnread {
+		t.Errorf("welcome should fill the buffer and keep room for the read state, got %v", types)
+	}
+}
+
+// connectTestClient는 c에 실제 웹 소켓을 연결하고 ServeHTTP처럼 read, write 고루틴을 시작한다.(read가 끝나면 방에서 나간다.)
+// 브라우저 쪽 연결과, read와 write 고루틴이 모두 끝나면 닫히는 채널을 리턴한다.
+func connectTestClient(t *testing.T, c *client) (*websocket.Conn, <-chan struct{}) {
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if socket, err := upgrader.Upgrade(w, req, nil); err == nil {
+			accepted <- socket
+		}
+	}))
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	c.socket, c.codec = <-accepted, jsonCodec{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		c.write()
+		wg.Done()
+	}()
+	go func() {
+		c.read()
+		c.room.exit(c)
+		wg.Done()
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return peer, done
+}
+
+func waitClosed(t *testing.T, done <-chan struct{}, msg string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal(msg)
+	}
+}
+
+func TestClientReadLimit(t *testing.T) {
+	r := newRoom("dev")
+	c := newTestClient(r, messageBufferSize)
+	go r.run()
+	defer r.shutdown()
+	peer, done := connectTestClient(t, c)
+
+	peer.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", maxMessageSize+1)))
+	if _, _, err := peer.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("oversized message = %v; want a %d close frame", err, websocket.CloseMessageTooBig)
+	}
+	waitClosed(t, done, "client that sent an oversized message should leave the room")
+}
+
+func TestClientCleanLeave(t *testing.T) {
+	r := newRoom("dev")
+	other := newTestClient(r, 10)
+	c := joinTestClient(r, messageBufferSize, "a", "alice")
+	go r.run()
+	defer r.shutdown()
+	peer, done := connectTestClient(t, c)
+
+	peer.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	waitClosed(t, done, "client should leave the room after a close frame")
+	for {
+		select {
+		case env := <-other.send:
+			if env.Type == typeLeave {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("other clients should get a leave event")
+		}
+	}
+}
+
+func TestClientPongDeadline(t *testing.T) {
+	defer func(wait, period time.Duration) { pongWait, pingPeriod = wait, period }(pongWait, pingPeriod)
+	pongWait, pingPeriod = 200*time.Millisecond, 50*time.Millisecond
+	r := newRoom("dev")
+	alive := newTestClient(r, messageBufferSize)
+	silent := newTestClient(r, messageBufferSize)
+	go r.run()
+	defer r.shutdown()
+	alivePeer, aliveDone := connectTestClient(t, alive)
+	_, silentDone := connectTestClient(t, silent) // 읽지 않으므로 ping에 pong으로 답하지 않는다.
+	go func() {
+		for { // ReadMessage가 ping을 받으면 pong으로 답한다.
+			if _, _, err := alivePeer.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	waitClosed(t, silentDone, "client that does not answer pings should be dropped after pongWait")
+	time.Sleep(3 * pongWait)
+	select {
+	case <-aliveDone:
+		t.Error("client that answers pings should stay connected past pongWait")
+	default:
+	}
+	alivePeer.Close()
+	waitClosed(t, aliveDone, "client should leave the room after its connection closed")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50  // limit을 지정하지 않았을 때 한 번에 돌려주는 메시지 수
+	maxPageSize     = 200 // limit의 최대값
+)
+
+// roomAPI는 /rooms/{name}/... 형식의 JSON API를 처리한다.
+// 웹 소켓과 같은 auth 쿠키를 사용하므로 MustAuth로 감싸서 등록한다.
+type roomAPI struct {
+	store MessageStore
+}
+
+func (a *roomAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // ["rooms", name, ...]
+	if len(segs) < 3 || !roomNamePattern.MatchString(segs[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	name := segs[1]
+	switch {
+	case len(segs) == 3 && segs[2] == "messages":
+		a.messages(w, r, name)
+	case len(segs) == 3 && segs[2] == "unread":
+		a.unread(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// messages는 방의 지난 메시지를 페이지 단위로 돌려준다.
+// GET /rooms/{name}/messages?before={id}&limit={n} - id보다 오래된 메시지 n개(무한 스크롤)
+// GET /rooms/{name}/messages?at={날짜}&limit={n}    - 날짜 이후의 첫 메시지부터 n개(날짜로 이동)
+// GET /rooms/{name}/messages?thread={id}            - id 메시지로 시작한 스레드(위 파라미터와 함께 사용할 수 있음)
+func (a *roomAPI) messages(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgs, err := a.store.Query(name, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+// unread는 로그인한 사용자가 방에서 읽지 않은 메시지 수를 돌려준다.
+// GET /rooms/{name}/unread -> {"room": name, "last_read": id, "unread": n}
+func (a *roomAPI) unread(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := authUserData(r)
+	if err != nil || user.Get("userid").Str() == "" {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return
+	}
+	lastRead, count, err := a.store.Unread(name, user.Get("userid").Str())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, unreadPayload{Room: name, LastRead: lastRead, Unread: count})
+}
+
+// parseHistoryQuery는 before, at, limit, thread 쿼리 파라미터를 historyQuery로 바꾼다.
+func parseHistoryQuery(r *http.Request) (historyQuery, error) {
+	q := historyQuery{Limit: defaultPageSize}
+	values := r.URL.Query()
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return q, errBadParam("limit")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		q.Limit = limit
+	}
+	if v := values.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			return q, errBadParam("before")
+		}
+		q.Before = before
+	}
+	if v := values.Get("thread"); v != "" {
+		thread, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || thread <= 0 {
+			return q, errBadParam("thread")
+		}
+		q.Thread = thread
+	}
+	if v := values.Get("at"); v != "" {
+		at, err := time.Parse(time.RFC3339, v) // 2021-03-01T09:00:00+09:00 또는
+		if err != nil {
+			at, err = time.ParseInLocation("2006-01-02", v, time.Local) // 2021-03-01
+		}
+		if err != nil {
+			return q, errBadParam("at")
+		}
+		q.Since = at
+	}
+	return q, nil
+}
+
+type errBadParam string
+
+func (e errBadParam) Error() string {
+	return "invalid " + string(e) + " parameter"
+}
+
+// writeJSON은 v를 JSON으로 인코딩해 응답한다.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
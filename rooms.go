@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRoom는 이름 없이 접속했을 때(/, /chat, /room) 사용하는 방 이름이다.
+const defaultRoom = "lobby"
+
+// 방 이름은 URL 경로에 그대로 들어가므로 영문, 숫자, -, _ 만 허용한다.
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// roomName은 prefix 뒤에 오는 방 이름을 꺼낸다.(예: roomName("/chat/dev", "/chat/") -> "dev")
+// 경로에 방 이름이 없으면 defaultRoom을, 올바르지 않은 이름이면 ok=false를 리턴한다.
+func roomName(path, prefix string) (name string, ok bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return defaultRoom, true
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(path, prefix), "/")
+	if name == "" {
+		return defaultRoom, true
+	}
+	if !roomNamePattern.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// roomRegistry는 이름별로 room을 보관하고 필요할 때 만들어 run 루프를 시작한다.
+// 클라이언트가 모두 나간 뒤 idleTimeout 동안 아무도 들어오지 않은 방은 정리된다.
+// 방은 auth 쿠키를 확인한 뒤에만 만들어지며, 한 번도 클라이언트가 들어오지 않은 방은 idleTimeout이 0이어도 정리된다.
+type roomRegistry struct {
+	mu          sync.Mutex
+	rooms       map[string]*room
+	newRoom     func(name string) *room // 방을 만들 때 사용하는 함수(main에서 tracer 등을 설정)
+	idleTimeout time.Duration
+	unusedTTL   time.Duration // 한 번도 클라이언트가 들어오지 않은 방을 정리하기까지 기다리는 시간
+	closed      bool          // shutdown이 호출된 뒤에는 새 방을 만들지 않는다.
+
+	online map[string]map[*room]bool // userid -> 그 사용자가 접속해 있는 방(DM 등 사용자에게 직접 보낼 때 사용)
+	users  *userDirectory            // 접속한 적 있는 사용자 정보(nil이면 기록하지 않음)
+}
+
+// unusedRoomTimeout은 방이 만들어진 뒤 인증이나 업그레이드에 실패해 아무도 들어오지 않은 방을 정리하기까지 기다리는 시간이다.
+const unusedRoomTimeout = time.Minute
+
+func newRoomRegistry(newRoom func(name string) *room, idleTimeout time.Duration) *roomRegistry {
+	return &roomRegistry{
+		rooms:       make(map[string]*room),
+		online:      make(map[string]map[*room]bool),
+		newRoom:     newRoom,
+		idleTimeout: idleTimeout,
+		unusedTTL:   unusedRoomTimeout,
+	}
+}
+
+// get은 name에 해당하는 방을 리턴하고, 없으면 새로 만들어 run 루프를 고루틴으로 실행한다.
+// 서버가 종료 중이면 nil을 리턴한다.
+func (reg *roomRegistry) get(name string) *room {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.closed {
+		return nil
+	}
+	if r, ok := reg.rooms[name]; ok {
+		return r
+	}
+	r := reg.newRoom(name)
+	r.idleTimeout = reg.idleTimeout
+	r.unusedTTL = reg.unusedTTL
+	r.registry = reg
+	reg.rooms[name] = r
+	go r.run()
+	return r
+}
+
+// remove는 비어있는 방을 레지스트리에서 뺀다. 이미 같은 이름으로 새 방이 만들어졌다면 건드리지 않는다.
+func (reg *roomRegistry) remove(r *room) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.rooms[r.name] == r {
+		delete(reg.rooms, r.name)
+	}
+}
+
+// track은 userID 사용자가 r 방에 접속했다고 기록한다. 방의 run 루프가 사용자의 첫 연결에서 호출한다.
+func (reg *roomRegistry) track(userID string, r *room) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rooms, ok := reg.online[userID]
+	if !ok {
+		rooms = make(map[*room]bool)
+		reg.online[userID] = rooms
+	}
+	rooms[r] = true
+}
+
+// untrack은 userID 사용자가 r 방에서 마지막 연결을 끊었다고 기록한다.
+func (reg *roomRegistry) untrack(userID string, r *room) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.online[userID], r)
+	if len(reg.online[userID]) == 0 {
+		delete(reg.online, userID)
+	}
+}
+
+// deliver는 userID 사용자가 접속해 있는 모든 방의 모든 클라이언트(탭)에게 env를 보낸다.
+// 방의 run 루프에서도 호출할 수 있도록 기다리지 않으며, 사용자가 접속해 있지 않으면 아무것도 하지 않는다.
+func (reg *roomRegistry) deliver(userID string, env *envelope) {
+	reg.deliverExcept(userID, nil, env)
+}
+
+// deliverExcept는 skip 방을 빼고 deliver와 같이 보낸다.(skip 방의 run 루프가 직접 보낸 경우)
+func (reg *roomRegistry) deliverExcept(userID string, skip *room, env *envelope) {
+	reg.mu.Lock()
+	rooms := make([]*room, 0, len(reg.online[userID]))
+	for r := range reg.online[userID] {
+		if r != skip {
+			rooms = append(rooms, r)
+		}
+	}
+	reg.mu.Unlock()
+	for _, r := range rooms {
+		r.notify(userID, env)
+	}
+}
+
+// isOnline은 userID 사용자가 어느 방에든 접속해 있는지 리턴한다.
+func (reg *roomRegistry) isOnline(userID string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.online[userID]) > 0
+}
+
+func (reg *roomRegistry) isClosed() bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.closed
+}
+
+// shutdown은 새 연결을 막고 모든 방에 종료를 알린 뒤, 클라이언트의 read/write 고루틴이 끝날 때까지 기다린다.
+// ctx가 먼저 끝나면 ctx.Err()를 리턴한다.
+func (reg *roomRegistry) shutdown(ctx context.Context) error {
+	reg.mu.Lock()
+	reg.closed = true
+	rooms := make([]*room, 0, len(reg.rooms))
+	for _, r := range reg.rooms {
+		rooms = append(rooms, r)
+	}
+	reg.rooms = make(map[string]*room)
+	reg.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		for _, r := range rooms {
+			r.shutdown()
+			<-r.done    // run 루프가 끝난 뒤에는 wg.Add가 호출되지 않는다.
+			r.wg.Wait() // going-away 프레임을 보내고 소켓이 닫힐 때까지
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// authenticate는 방을 만들기 전에 auth 쿠키를 확인한다.(로그인하지 않은 요청이 방과 run 고루틴을 만들지 못하게 한다.)
+// ban 확인과 사용자 기록은 방이 생긴 뒤 room.authorize가 한다.
+func (reg *roomRegistry) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	if reg.isClosed() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	if _, err := authUserData(req); err != nil {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ServeHTTP는 /room/{name} 요청을 해당 방의 웹 소켓 핸들러로 넘긴다.
+func (reg *roomRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, ok := roomName(req.URL.Path, "/room/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if !reg.authenticate(w, req) {
+		return
+	}
+	r := reg.get(name)
+	if r == nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	r.ServeHTTP(w, req)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func TestRoomName(t *testing.T) {
+	cases := []struct {
+		path string
+		name string
+		ok   bool
+	}{
+		{"/room", defaultRoom, true},
+		{"/room/", defaultRoom, true},
+		{"/room/dev", "dev", true},
+		{"/room/dev/", "dev", true},
+		{"/room/project_x-1", "project_x-1", true},
+		{"/room/a/b", "", false},
+		{"/room/hello world", "", false},
+	}
+	for _, c := range cases {
+		name, ok := roomName(c.path, "/room/")
+		if name != c.name || ok != c.ok {
+			t.Errorf("roomName(%q) = %q, %v; want %q, %v", c.path, name, ok, c.name, c.ok)
+		}
+	}
+}
+
+func TestRoomRegistryGet(t *testing.T) {
+	reg := newRoomRegistry(newRoom, 0)
+	dev := reg.get("dev")
+	if dev.name != "dev" {
+		t.Errorf("room name should be dev, got %s", dev.name)
+	}
+	if reg.get("dev") != dev {
+		t.Error("roomRegistry.get should return the same room for the same name")
+	}
+	if reg.get("ops") == dev {
+		t.Error("roomRegistry.get should return different rooms for different names")
+	}
+}
+
+func TestRoomRegistryIdle(t *testing.T) {
+	reg := newRoomRegistry(newRoom, 10*time.Millisecond)
+	r := reg.get("dev")
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("empty room should be closed after idleTimeout")
+	}
+	if reg.get("dev") == r {
+		t.Error("roomRegistry.get should create a new room after the old one was closed")
+	}
+	if r.enter(&client{send: make(chan *envelope)}) {
+		t.Error("room.enter should fail on a closed room")
+	}
+}
+
+func TestRoomRegistryRequiresAuthBeforeCreating(t *testing.T) {
+	reg := newRoomRegistry(newRoom, 0)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/room/random", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without auth cookie should get 401, got %d", w.Code)
+	}
+	reg.mu.Lock()
+	n := len(reg.rooms)
+	reg.mu.Unlock()
+	if n != 0 {
+		t.Errorf("unauthenticated request should not create a room, got %d rooms", n)
+	}
+}
+
+func TestRoomRegistryClosesUnusedRoom(t *testing.T) {
+	reg := newRoomRegistry(newRoom, 0) // 0이면 빈 방을 정리하지 않지만, 아무도 들어오지 않은 방은 예외
+	reg.unusedTTL = 10 * time.Millisecond
+	r := reg.get("dev")
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("room that never had a client should be closed even with idleTimeout 0")
+	}
+	if reg.get("dev") == r {
+		t.Error("roomRegistry.get should create a new room after the unused one was closed")
+	}
+}
+
+func TestRoomRegistryShutdown(t *testing.T) {
+	reg := newRoomRegistry(newRoom, time.Minute)
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	dial := func(path, userid string) *websocket.Conn {
+		t.Helper()
+		cookie := objx.New(map[string]interface{}{"userid": userid, "name": userid}).MustBase64()
+		header := http.Header{"Cookie": {"auth=" + cookie}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil { // 첫 envelope를 받으면 방에 들어온 것이다.
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conns := []*websocket.Conn{dial("/room/dev", "alice"), dial("/room/dev", "bob"), dial("/room/ops", "carol")}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	closed := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *websocket.Conn) {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					closed <- err
+					return
+				}
+			}
+		}(conn)
+	}
+	if err := reg.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown should finish before the timeout, got %v", err)
+	}
+	for range conns {
+		if err := <-closed; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("client got %v; want a %d close frame", err, websocket.CloseGoingAway)
+		}
+	}
+	if reg.get("dev") != nil {
+		t.Error("roomRegistry.get should not create rooms after shutdown")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// roomSettings는 방이 정리됐다가 다시 만들어져도 유지해야 하는 방의 설정이다.
+type roomSettings struct {
+	Topic   string              `json:"topic,omitempty"`
+	TopicBy string              `json:"topic_by,omitempty"` // 주제를 정한 사용자의 이름
+	TopicAt time.Time           `json:"topic_at,omitempty"`
+	Nicks   map[string]string   `json:"nicks,omitempty"` // userid -> /nick으로 정한 이 방에서의 이름
+	Bans    map[string]sanction `json:"bans,omitempty"`  // userid -> 다시 들어올 수 없는 사용자
+	Mutes   map[string]sanction `json:"mutes,omitempty"` // userid -> 메시지를 보낼 수 없는 사용자
+}
+
+// settingsStore는 방별 설정을 보관한다. path가 비어있지 않으면 바뀔 때마다 JSON 파일로 저장한다.
+// 설정은 방의 run 루프에서 바뀌므로, 느린 디스크가 방을 막지 않도록 파일은 writer 고루틴이 쓴다.
+type settingsStore struct {
+	mu    sync.RWMutex
+	path  string
+	Rooms map[string]*roomSettings `json:"rooms"` // 방 이름 -> 설정
+
+	dirty   chan struct{}   // 파일에 쓸 변경이 있음(여러 번 바뀌어도 한 번만 쓴다.)
+	flushes chan chan error // flush 요청(남은 변경을 쓴 뒤 결과를 돌려준다.)
+}
+
+func newSettingsStore(path string) (*settingsStore, error) {
+	s := &settingsStore{path: path, Rooms: make(map[string]*roomSettings)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+	}
+	if s.Rooms == nil {
+		s.Rooms = make(map[string]*roomSettings)
+	}
+	s.dirty = make(chan struct{}, 1)
+	s.flushes = make(chan chan error)
+	go s.write()
+	return s, nil
+}
+
+// save는 설정을 파일에 쓰도록 writer에게 알린다. 기다리지 않으므로 run 루프에서 호출해도 된다.
+func (s *settingsStore) save() {
+	if s.path == "" {
+		return
+	}
+	select {
+	case s.dirty <- struct{}{}:
+	default: // 이미 쓸 차례를 기다리는 중(그때 최신 설정을 쓴다.)
+	}
+}
+
+// write는 바뀐 설정을 파일에 쓰는 writer 고루틴이다.
+func (s *settingsStore) write() {
+	for {
+		select {
+		case <-s.dirty:
+			if err := s.writeFile(); err != nil {
+				log.Println("Failed to save room settings:", err)
+			}
+		case done := <-s.flushes:
+			var err error
+			select {
+			case <-s.dirty:
+				err = s.writeFile()
+			default:
+			}
+			done <- err
+		}
+	}
+}
+
+// writeFile은 지금 설정을 파일에 쓴다.(임시 파일에 쓴 뒤 바꿔치기)
+func (s *settingsStore) writeFile() error {
+	s.mu.RLock()
+	data, err := json.Marshal(s)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// flush는 아직 쓰지 않은 변경을 파일에 쓸 때까지 기다린다.(서버를 끝낼 때 호출)
+func (s *settingsStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+	done := make(chan error)
+	s.flushes <- done
+	return <-done
+}
+
+// topic은 room 방의 주제와 정한 사람, 시각을 리턴한다.
+func (s *settingsStore) topic(room string) (topic, by string, at time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rs, ok := s.Rooms[room]; ok {
+		return rs.Topic, rs.TopicBy, rs.TopicAt
+	}
+	return "", "", time.Time{}
+}
+
+// setTopic은 room 방의 주제를 바꾼다. topic이 비어있으면 지운다.
+func (s *settingsStore) setTopic(room, topic, by string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := s.room(room)
+	rs.Topic, rs.TopicBy, rs.TopicAt = topic, by, at
+	s.save()
+}
+
+// nick은 room 방에서 userID 사용자가 정한 이름을 리턴한다.(없으면 빈 문자열)
+func (s *settingsStore) nick(room, userID string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rs, ok := s.Rooms[room]; ok {
+		return rs.Nicks[userID]
+	}
+	return ""
+}
+
+// setNick은 room 방에서 userID 사용자의 이름을 정한다. nick이 비어있으면 원래 이름으로 돌아간다.
+func (s *settingsStore) setNick(room, userID, nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := s.room(room)
+	if nick == "" {
+		delete(rs.Nicks, userID)
+	} else {
+		if rs.Nicks == nil {
+			rs.Nicks = make(map[string]string)
+		}
+		rs.Nicks[userID] = nick
+	}
+	s.save()
+}
+
+// room은 room 방의 설정을 리턴하고, 없으면 만든다. s.mu를 잡은 상태에서 호출해야 한다.
+func (s *settingsStore) room(room string) *roomSettings {
+	rs, ok := s.Rooms[room]
+	if !ok {
+		rs = &roomSettings{}
+		s.Rooms[room] = rs
+	}
+	return rs
+}
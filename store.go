@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageStore는 방에서 오간 메시지를 보관한다.
+// room.run이 메시지를 전달하기 전에 Append를 호출하고, 새 클라이언트가 들어오면 Query로 지난 메시지를 보내준다.
+type MessageStore interface {
+	// Append는 room 방의 메시지를 저장하고 msg.ID에 새 ID를 채운다.
+	// msg.ParentID가 있으면 스레드를 시작한 메시지의 답글 수와 마지막 답글 시각도 갱신한다.
+	Append(room string, msg *message) error
+	// Query는 room 방에서 q에 맞는 메시지를 오래된 순서로 리턴한다.(q.Thread가 0이면 답글은 빼고 리턴)
+	Query(room string, q historyQuery) ([]*message, error)
+	// MarkRead는 userID 사용자가 room 방에서 id 메시지까지 읽었다고 기록한다.(이전 기록보다 작으면 무시)
+	MarkRead(room, userID string, id int64) error
+	// Receipts는 room 방의 사용자별 마지막으로 읽은 메시지 ID를 리턴한다.
+	Receipts(room string) (map[string]int64, error)
+	// Get은 room 방의 id 메시지를 리턴한다. 없으면 ErrMessageNotFound를 리턴한다.
+	Get(room string, id int64) (*message, error)
+	// Edit은 id 메시지의 내용을 text로 바꾸고, 바뀌기 전 내용을 Revisions에 남긴다.
+	Edit(room string, id int64, text, by string, when time.Time) (*message, error)
+	// Delete는 id 메시지를 지운 것으로 표시하고, 지우기 전 내용을 Revisions에 남긴다.
+	Delete(room string, id int64, by string, when time.Time) (*message, error)
+	// React는 userID 사용자의 emoji 반응을 id 메시지에 더하거나(add가 true) 뺀다. 이미 그런 상태면 바꾸지 않는다.
+	React(room string, id int64, emoji, userID string, add bool) (*message, error)
+	// Unread는 userID 사용자가 room 방에서 마지막으로 읽은 메시지 ID와 그 뒤에 온 다른 사람의 메시지 수를 리턴한다.
+	Unread(room, userID string) (lastRead int64, count int, err error)
+	// Close는 아직 쓰지 못한 내용을 정리하고 저장소를 닫는다.
+	Close() error
+}
+
+// ErrMessageNotFound는 저장소에 해당 ID의 메시지가 없을 때 리턴되는 에러다.
+var ErrMessageNotFound = errors.New("chat: message not found")
+
+// historyQuery는 메시지 기록을 가져오는 조건이다. 아무 조건이 없으면 최근 메시지를 가져온다.
+type historyQuery struct {
+	Before int64     // 0이 아니면 이 ID보다 앞선(오래된) 메시지 중 가장 최근 것들
+	Since  time.Time // 0이 아니면 이 시각 이후의 첫 메시지부터(날짜로 이동할 때 사용)
+	Limit  int       // 최대 개수(0이면 제한 없음)
+	Thread int64     // 0이 아니면 이 메시지로 시작한 스레드(첫 메시지와 답글)만
+}
+
+// memoryStore는 메시지를 메모리에만 보관하는 MessageStore이다.(서버를 다시 시작하면 사라진다.)
+type memoryStore struct {
+	mu    sync.RWMutex
+	rooms map[string][]*message
+	reads map[string]map[string]int64 // 방 이름 -> userid -> 마지막으로 읽은 메시지 ID
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		rooms: make(map[string][]*message),
+		reads: make(map[string]map[string]int64),
+	}
+}
+
+// nextID는 room 방에 다음으로 저장될 메시지의 ID를 리턴한다.
+func (s *memoryStore) nextID(room string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if msgs := s.rooms[room]; len(msgs) > 0 {
+		return msgs[len(msgs)-1].ID + 1
+	}
+	return 1
+}
+
+func (s *memoryStore) Append(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.rooms[room]
+	if msg.ID == 0 { // 디스크에서 읽어 온 메시지는 이미 ID가 있다.
+		msg.ID = 1
+		if len(msgs) > 0 {
+			msg.ID = msgs[len(msgs)-1].ID + 1
+		}
+	}
+	m := *msg // 보낸 쪽에서 msg를 계속 사용하므로 복사본을 저장
+	m.acked = nil
+	s.rooms[room] = append(msgs, &m)
+	if msg.ParentID != 0 {
+		if parent := s.find(room, msg.ParentID); parent != nil {
+			when := msg.When
+			parent.Replies++
+			parent.LastReply = &when
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Query(room string, q historyQuery) ([]*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := threadMessages(s.rooms[room], q.Thread) // ID 순서로 정렬되어 있으므로 이진 탐색을 사용할 수 있다.
+	switch {
+	case q.Before > 0:
+		end := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= q.Before })
+		msgs = msgs[:end]
+	case !q.Since.IsZero():
+		start := sort.Search(len(msgs), func(i int) bool { return !msgs[i].When.Before(q.Since) })
+		msgs = msgs[start:]
+		if q.Limit > 0 && len(msgs) > q.Limit { // 날짜로 이동할 때는 그 시각부터 앞쪽 limit개
+			msgs = msgs[:q.Limit]
+		}
+	}
+	if q.Limit > 0 && len(msgs) > q.Limit {
+		msgs = msgs[len(msgs)-q.Limit:]
+	}
+	return copyMessages(msgs), nil
+}
+
+func (s *memoryStore) MarkRead(room, userID string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last := s.lastID(room); id > last { // 아직 없는 메시지까지 읽을 수는 없다.(빈 방이면 0)
+		id = last
+	}
+	reads, ok := s.reads[room]
+	if !ok {
+		reads = make(map[string]int64)
+		s.reads[room] = reads
+	}
+	if id > reads[userID] {
+		reads[userID] = id
+	}
+	return nil
+}
+
+// lastID는 room 방의 마지막 메시지 ID를 리턴한다.(빈 방이면 0) s.mu를 잡은 상태에서 호출해야 한다.
+func (s *memoryStore) lastID(room string) int64 {
+	msgs := s.rooms[room]
+	if len(msgs) == 0 {
+		return 0
+	}
+	return msgs[len(msgs)-1].ID
+}
+
+// readable은 id를 room 방에서 읽었다고 기록할 수 있는 가장 큰 ID로 줄인다.
+func (s *memoryStore) readable(room string, id int64) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if last := s.lastID(room); id > last {
+		return last
+	}
+	return id
+}
+
+func (s *memoryStore) Receipts(room string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]int64, len(s.reads[room]))
+	for userID, id := range s.reads[room] {
+		out[userID] = id
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Unread(room, userID string) (int64, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lastRead := s.reads[room][userID]
+	msgs := s.rooms[room]
+	start := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID > lastRead })
+	count := 0
+	for _, msg := range msgs[start:] {
+		if msg.UserID != userID && msg.ParentID == 0 { // 자기가 보낸 메시지와 스레드 답글은 읽지 않은 것으로 세지 않는다.
+			count++
+		}
+	}
+	return lastRead, count, nil
+}
+
+// threadMessages는 msgs 중 thread 스레드의 메시지만 골라 리턴한다.(thread가 0이면 답글이 아닌 메시지)
+func threadMessages(msgs []*message, thread int64) []*message {
+	out := make([]*message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.ParentID == thread || (thread != 0 && msg.ID == thread) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// find는 room 방에서 id 메시지를 찾는다. s.mu를 잡은 상태에서 호출해야 한다.
+func (s *memoryStore) find(room string, id int64) *message {
+	msgs := s.rooms[room]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= id })
+	if i < len(msgs) && msgs[i].ID == id {
+		return msgs[i]
+	}
+	return nil
+}
+
+func (s *memoryStore) Get(room string, id int64) (*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msg := s.find(room, id)
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	m := *msg
+	return &m, nil
+}
+
+func (s *memoryStore) Edit(room string, id int64, text, by string, when time.Time) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.find(room, id)
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	msg.Revisions = append(msg.Revisions, revision{Message: msg.Message, By: by, When: when})
+	msg.Message = text
+	msg.Edited = true
+	m := *msg
+	return &m, nil
+}
+
+func (s *memoryStore) Delete(room string, id int64, by string, when time.Time) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.find(room, id)
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	msg.Revisions = append(msg.Revisions, revision{Message: msg.Message, By: by, When: when, Deleted: true})
+	msg.Message = ""
+	msg.Deleted = true
+	m := *msg
+	return &m, nil
+}
+
+func (s *memoryStore) React(room string, id int64, emoji, userID string, add bool) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.find(room, id)
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	msg.Reactions = react(msg.Reactions, emoji, userID, add)
+	m := *msg
+	return &m, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copyMessages는 저장소 내부의 메시지를 밖에서 수정하지 못하도록 복사한다.
+func copyMessages(msgs []*message) []*message {
+	out := make([]*message, len(msgs))
+	for i, msg := range msgs {
+		m := *msg
+		out[i] = &m
+	}
+	return out
+}
+
+// logRecord는 로그 파일의 한 줄을 나타낸다.
+type logRecord struct {
+	Op      string    `json:"op"` // "add"(메시지 추가), "read"(읽음 표시), "edit"(수정), "delete"(삭제), "react"/"unreact"(반응)
+	Message *message  `json:"message,omitempty"`
+	UserID  string    `json:"userid,omitempty"`
+	ID      int64     `json:"id,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Emoji   string    `json:"emoji,omitempty"`
+	When    time.Time `json:"when,omitempty"`
+}
+
+// apply는 로그 파일에서 읽은 기록 하나를 메모리에 반영한다.
+func (s *fileStore) apply(room string, rec *logRecord) {
+	switch rec.Op {
+	case "add":
+		if rec.Message != nil {
+			s.mem.Append(room, rec.Message)
+		}
+	case "read":
+		s.mem.MarkRead(room, rec.UserID, rec.ID)
+	case "edit":
+		s.mem.Edit(room, rec.ID, rec.Text, rec.UserID, rec.When)
+	case "delete":
+		s.mem.Delete(room, rec.ID, rec.UserID, rec.When)
+	case "react", "unreact":
+		s.mem.React(room, rec.ID, rec.Emoji, rec.UserID, rec.Op == "react")
+	}
+}
+
+// fileStore는 방마다 dir/{room}.log 파일에 JSON 한 줄씩 추가(append-only)해 메시지를 디스크에 보관한다.
+// 방의 로그는 처음 사용될 때 메모리로 읽어 들이고, 이후 조회는 메모리에서 처리한다.
+type fileStore struct {
+	mu     sync.Mutex
+	dir    string
+	mem    *memoryStore
+	files  map[string]*os.File // 방 이름 -> 열려 있는 로그 파일
+	closed bool
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{
+		dir:   dir,
+		mem:   newMemoryStore(),
+		files: make(map[string]*os.File),
+	}, nil
+}
+
+// open은 room 방의 로그 파일을 열고, 처음 여는 경우 기존 기록을 메모리로 읽어 들인다. s.mu를 잡은 상태에서 호출해야 한다.
+// create가 false이면 파일이 없을 때 만들지 않고 nil을 리턴한다.(조회만으로 빈 파일이 생기지 않도록)
+func (s *fileStore) open(room string, create bool) (*os.File, error) {
+	if f, ok := s.files[room]; ok {
+		return f, nil
+	}
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	if strings.ContainsAny(room, `/\`) || strings.Contains(room, "..") { // 방 이름이 디렉터리 밖을 가리키지 못하게 한다.
+		return nil, fmt.Errorf("invalid room name %q", room)
+	}
+	flag := os.O_RDWR | os.O_APPEND
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, room+".log"), flag, 0644)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // 마지막 줄이 쓰다가 끊긴 경우 등은 건너뛴다.
+		}
+		s.apply(room, &rec)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.files[room] = f
+	return f, nil
+}
+
+// write는 room 방의 로그 파일 끝에 기록 하나를 JSON 한 줄로 쓴다. s.mu를 잡은 상태에서 호출해야 한다.
+func (s *fileStore) write(room string, rec logRecord) error {
+	f, err := s.open(room, true)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// load는 room 방의 로그를 아직 읽지 않았다면 메모리로 읽어 들인다.
+func (s *fileStore) load(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.open(room, false)
+	return err
+}
+
+func (s *fileStore) Append(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.open(room, true); err != nil {
+		return err
+	}
+	msg.ID = s.mem.nextID(room) // 파일에 쓰기 전에 ID를 정해야 다시 읽을 때도 같은 ID가 된다.
+	if err := s.write(room, logRecord{Op: "add", Message: msg}); err != nil {
+		return err
+	}
+	return s.mem.Append(room, msg)
+}
+
+func (s *fileStore) Query(room string, q historyQuery) ([]*message, error) {
+	if err := s.load(room); err != nil {
+		return nil, err
+	}
+	return s.mem.Query(room, q)
+}
+
+func (s *fileStore) MarkRead(room, userID string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.open(room, true); err != nil {
+		return err
+	}
+	// 아직 없는 메시지 ID를 로그에 남기지 않는다.
+	id = s.mem.readable(room, id)
+	if lastRead, _, _ := s.mem.Unread(room, userID); id <= lastRead { // 바뀌는 것이 없으면 파일에 쓰지 않는다.
+		return nil
+	}
+	if err := s.write(room, logRecord{Op: "read", UserID: userID, ID: id}); err != nil {
+		return err
+	}
+	return s.mem.MarkRead(room, userID, id)
+}
+
+func (s *fileStore) Receipts(room string) (map[string]int64, error) {
+	if err := s.load(room); err != nil {
+		return nil, err
+	}
+	return s.mem.Receipts(room)
+}
+
+func (s *fileStore) Unread(room, userID string) (int64, int, error) {
+	if err := s.load(room); err != nil {
+		return 0, 0, err
+	}
+	return s.mem.Unread(room, userID)
+}
+
+func (s *fileStore) Get(room string, id int64) (*message, error) {
+	if err := s.load(room); err != nil {
+		return nil, err
+	}
+	return s.mem.Get(room, id)
+}
+
+func (s *fileStore) Edit(room string, id int64, text, by string, when time.Time) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.exists(room, id); err != nil {
+		return nil, err
+	}
+	if err := s.write(room, logRecord{Op: "edit", ID: id, Text: text, UserID: by, When: when}); err != nil {
+		return nil, err
+	}
+	return s.mem.Edit(room, id, text, by, when)
+}
+
+func (s *fileStore) Delete(room string, id int64, by string, when time.Time) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.exists(room, id); err != nil {
+		return nil, err
+	}
+	if err := s.write(room, logRecord{Op: "delete", ID: id, UserID: by, When: when}); err != nil {
+		return nil, err
+	}
+	return s.mem.Delete(room, id, by, when)
+}
+
+func (s *fileStore) React(room string, id int64, emoji, userID string, add bool) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.exists(room, id); err != nil {
+		return nil, err
+	}
+	op := "unreact"
+	if add {
+		op = "react"
+	}
+	if err := s.write(room, logRecord{Op: op, ID: id, Emoji: emoji, UserID: userID}); err != nil {
+		return nil, err
+	}
+	return s.mem.React(room, id, emoji, userID, add)
+}
+
+// exists는 로그에 기록을 남기기 전에 메시지가 있는지 확인한다. s.mu를 잡은 상태에서 호출해야 한다.
+func (s *fileStore) exists(room string, id int64) error {
+	if _, err := s.open(room, false); err != nil {
+		return err
+	}
+	_, err := s.mem.Get(room, id)
+	return err
+}
+
+// Close는 열려 있는 로그 파일을 디스크에 동기화하고 닫는다.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for room, f := range s.files {
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, room)
+	}
+	s.closed = true
+	return firstErr
+}
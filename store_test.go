@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testMessageStore(t *testing.T, store MessageStore) {
+	for i := 1; i <= 5; i++ {
+		if err := store.Append("dev", &message{UserID: "u1", Name: "tester", Message: fmt.Sprint("msg", i)}); err != nil {
+			t.Fatalf("Append should not return an error: %s", err)
+		}
+	}
+	store.Append("ops", &message{Message: "other room"})
+
+	msgs, err := store.Query("dev", historyQuery{Limit: 3})
+	if err != nil {
+		t.Fatalf("Query should not return an error: %s", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("Query should return 3 messages, got %d", len(msgs))
+	}
+	for i, want := range []string{"msg3", "msg4", "msg5"} {
+		if msgs[i].Message != want {
+			t.Errorf("Query[%d] = %s; want %s", i, msgs[i].Message, want)
+		}
+	}
+	if msgs, _ := store.Query("empty", historyQuery{Limit: 3}); len(msgs) != 0 {
+		t.Errorf("Query should return no messages for an empty room, got %d", len(msgs))
+	}
+
+	if err := store.MarkRead("dev", "u2", 3); err != nil {
+		t.Fatalf("MarkRead should not return an error: %s", err)
+	}
+	store.MarkRead("dev", "u2", 2) // 뒤로 돌아가지 않는다.
+	if lastRead, count, _ := store.Unread("dev", "u2"); lastRead != 3 || count != 2 {
+		t.Errorf("Unread = %d, %d; want 3, 2", lastRead, count)
+	}
+	if _, count, _ := store.Unread("dev", "u1"); count != 0 {
+		t.Errorf("own messages should not count as unread, got %d", count)
+	}
+	if receipts, _ := store.Receipts("dev"); len(receipts) != 1 || receipts["u2"] != 3 {
+		t.Errorf("Receipts = %v; want map[u2:3]", receipts)
+	}
+
+	store.MarkRead("empty", "u2", 99) // 빈 방에서는 나중에 올 메시지까지 읽었다고 기록할 수 없다.
+	if lastRead, _, _ := store.Unread("empty", "u2"); lastRead != 0 {
+		t.Errorf("MarkRead in an empty room should be clamped to 0, got %d", lastRead)
+	}
+	store.MarkRead("dev", "u3", 99)
+	if lastRead, _, _ := store.Unread("dev", "u3"); lastRead != 5 {
+		t.Errorf("MarkRead past the last message should be clamped to 5, got %d", lastRead)
+	}
+
+	if msg, err := store.Edit("dev", 4, "msg4 fixed", "u1", time.Now()); err != nil || !msg.Edited || msg.Message != "msg4 fixed" {
+		t.Errorf("Edit = %+v, %v; want an edited message", msg, err)
+	}
+	if msg, err := store.Delete("dev", 5, "mod", time.Now()); err != nil || !msg.Deleted || msg.Message != "" {
+		t.Errorf("Delete = %+v, %v; want a deleted message", msg, err)
+	}
+	store.React("dev", 3, "👍", "u1", true)
+	store.React("dev", 3, "👍", "u2", true)
+	store.React("dev", 3, "🎉", "u2", true)
+	if msg, err := store.React("dev", 3, "🎉", "u2", false); err != nil || len(msg.Reactions) != 1 || msg.Reactions[0].Count != 2 {
+		t.Errorf("React = %+v, %v; want 2 thumbs up", msg, err)
+	}
+	if _, err := store.Edit("dev", 99, "nope", "u1", time.Now()); err != ErrMessageNotFound {
+		t.Errorf("Edit of a missing message = %v; want ErrMessageNotFound", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMessageStore(t, newMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("newFileStore should not return an error: %s", err)
+	}
+	testMessageStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close should not return an error: %s", err)
+	}
+
+	// 다시 열었을 때 디스크에 남은 기록을 읽어와야 한다.
+	store, err = newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	msgs, err := store.Query("dev", historyQuery{})
+	if err != nil {
+		t.Fatalf("Query should not return an error: %s", err)
+	}
+	if len(msgs) != 5 || msgs[3].Message != "msg4 fixed" || !msgs[4].Deleted {
+		t.Errorf("FileStore should reload 5 messages with edits from disk, got %d", len(msgs))
+	}
+	if msg, _ := store.Get("dev", 3); len(msg.Reactions) != 1 || msg.Reactions[0].Emoji != "👍" || msg.Reactions[0].Count != 2 {
+		t.Errorf("FileStore should reload reactions from disk, got %+v", msg.Reactions)
+	}
+	if msg, _ := store.Get("dev", 4); len(msg.Revisions) != 1 || msg.Revisions[0].Message != "msg4" {
+		t.Errorf("FileStore should reload the revision trail, got %+v", msg.Revisions)
+	}
+	if lastRead, _, _ := store.Unread("dev", "u2"); lastRead != 3 {
+		t.Errorf("FileStore should reload read receipts from disk, got %d", lastRead)
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	store := newMemoryStore()
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		msg := &message{Message: fmt.Sprint("msg", i+1), When: start.Add(time.Duration(i) * time.Hour)}
+		store.Append("dev", msg)
+		if msg.ID != int64(i+1) {
+			t.Fatalf("Append should assign ID %d, got %d", i+1, msg.ID)
+		}
+	}
+
+	msgs, _ := store.Query("dev", historyQuery{Before: 6, Limit: 3})
+	if len(msgs) != 3 || msgs[0].ID != 3 || msgs[2].ID != 5 {
+		t.Errorf("Query before 6 should return IDs 3..5, got %v", messageIDs(msgs))
+	}
+	msgs, _ = store.Query("dev", historyQuery{Before: 2, Limit: 3})
+	if len(msgs) != 1 || msgs[0].ID != 1 {
+		t.Errorf("Query before 2 should return ID 1, got %v", messageIDs(msgs))
+	}
+	msgs, _ = store.Query("dev", historyQuery{Since: start.Add(90 * time.Minute), Limit: 2})
+	if len(msgs) != 2 || msgs[0].ID != 3 || msgs[1].ID != 4 {
+		t.Errorf("Query since 01:30 should return IDs 3..4, got %v", messageIDs(msgs))
+	}
+}
+
+func TestMemoryStoreThreads(t *testing.T) {
+	store := newMemoryStore()
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	store.Append("dev", &message{UserID: "a", Message: "root", When: start})                                     // 1
+	store.Append("dev", &message{UserID: "b", Message: "reply1", ParentID: 1, When: start.Add(time.Minute)})     // 2
+	store.Append("dev", &message{UserID: "a", Message: "other", When: start.Add(2 * time.Minute)})               // 3
+	store.Append("dev", &message{UserID: "b", Message: "reply2", ParentID: 1, When: start.Add(3 * time.Minute)}) // 4
+
+	root, _ := store.Get("dev", 1)
+	if root.Replies != 2 || root.LastReply == nil || !root.LastReply.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("root should have 2 replies with the last at 00:03, got %d, %v", root.Replies, root.LastReply)
+	}
+	if msgs, _ := store.Query("dev", historyQuery{}); len(msgs) != 2 || msgs[0].ID != 1 || msgs[1].ID != 3 {
+		t.Errorf("Query should leave replies out of the room, got %v", messageIDs(msgs))
+	}
+	if msgs, _ := store.Query("dev", historyQuery{Thread: 1}); len(msgs) != 3 || msgs[0].ID != 1 || msgs[2].ID != 4 {
+		t.Errorf("Query for thread 1 should return IDs 1, 2, 4, got %v", messageIDs(msgs))
+	}
+	if _, count, _ := store.Unread("dev", "a"); count != 0 {
+		t.Errorf("replies should not count as unread in the room, got %d", count)
+	}
+}
+
+func TestReact(t *testing.T) {
+	var rs []reaction
+	rs = react(rs, "👍", "a", true)
+	rs = react(rs, "👍", "a", true) // 같은 사용자가 두 번 반응해도 한 번만 센다.
+	before := rs
+	rs = react(rs, "👍", "b", true)
+	if len(rs) != 1 || rs[0].Count != 2 || len(rs[0].Users) != 2 {
+		t.Fatalf("react should count 2 users, got %+v", rs)
+	}
+	if before[0].Count != 1 || len(before[0].Users) != 1 {
+		t.Error("react should not modify the original slice")
+	}
+	rs = react(rs, "👍", "a", false)
+	rs = react(rs, "👍", "b", false)
+	if rs != nil {
+		t.Errorf("react should drop emojis without users, got %+v", rs)
+	}
+}
+
+func messageIDs(msgs []*message) []int64 {
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
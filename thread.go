@@ -0,0 +1,102 @@
+package main
+
+// threadPayload는 subscribe, unsubscribe 프레임의 payload이다.
+type threadPayload struct {
+	Thread int64 `json:"thread"`
+}
+
+// threadSignal은 client.read가 room에 전달하는 스레드 구독 변경이다.
+type threadSignal struct {
+	from *client
+	id   int64 // 스레드를 시작한 메시지의 ID
+	on   bool  // true면 구독, false면 구독 해제
+}
+
+// threadRoot는 id 메시지가 속한 스레드의 첫 메시지 ID를 리턴한다.
+// 답글에 다시 답글을 달면 같은 스레드에 이어 붙이므로 스레드는 한 단계만 있다.
+func (r *room) threadRoot(id int64) (int64, error) {
+	if r.store == nil {
+		return 0, &frameError{"unavailable", "threads need message history"}
+	}
+	if id <= 0 {
+		return 0, &frameError{"invalid", "thread id must be positive"}
+	}
+	msg, err := r.store.Get(r.name, id)
+	if err == ErrMessageNotFound {
+		return 0, &frameError{"not_found", "message not found"}
+	} else if err != nil {
+		return 0, err
+	}
+	if msg.ParentID != 0 {
+		return msg.ParentID, nil
+	}
+	return msg.ID, nil
+}
+
+func (c *client) handleSubscribe(f *frame) error {
+	return c.sendThread(f, true)
+}
+
+func (c *client) handleUnsubscribe(f *frame) error {
+	return c.sendThread(f, false)
+}
+
+func (c *client) sendThread(f *frame, on bool) error {
+	var p threadPayload
+	if err := f.decodePayload(&p); err != nil {
+		return err
+	}
+	root, err := c.room.threadRoot(p.Thread)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.room.threads <- threadSignal{from: c, id: root, on: on}:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// watch는 c의 id 스레드 구독을 켜거나 끈다. run 루프 안에서만 호출해야 한다.
+func (r *room) watch(c *client, id int64, on bool) {
+	subs := r.watchers[id]
+	if !on {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(r.watchers, id)
+		}
+		return
+	}
+	if subs == nil {
+		subs = make(map[*client]bool)
+		r.watchers[id] = subs
+	}
+	subs[c] = true
+}
+
+// unwatchAll은 방을 나가는 c의 모든 스레드 구독을 지운다. run 루프 안에서만 호출해야 한다.
+func (r *room) unwatchAll(c *client) {
+	for id := range r.watchers {
+		r.watch(c, id, false)
+	}
+}
+
+// postReply는 저장된 답글을 스레드 구독자에게 보내고,
+// 답글 수와 마지막 답글 시각이 바뀐 첫 메시지를 update 이벤트로 방 전체에 알린다. run 루프 안에서만 호출해야 한다.
+// 답글을 쓴 사용자의 클라이언트는 스레드를 자동으로 구독하고, 답글은 다시 연결하는 클라이언트를 위해 backlog에 남긴다.
+func (r *room) postReply(msg *message) {
+	env := newEnvelope(typeReply, msg)
+	r.record(env)
+	for c := range r.clients {
+		if msg.UserID != "" && c.userID() == msg.UserID {
+			r.watch(c, msg.ParentID, true)
+		}
+	}
+	for c := range r.watchers[msg.ParentID] {
+		r.sendTo(c, env)
+	}
+	if parent, err := r.store.Get(r.name, msg.ParentID); err == nil {
+		r.publish(newEnvelope(typeUpdate, parent))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// closeIdle은 poll이 오지 않아 정리한 long-poll 세션에 알려주는 코드이다.(closeKicked, closeBanned와 같은 범위)
+const closeIdle = 4003
+
+const (
+	pollTimeout  = 25 * time.Second // long-poll 요청 하나가 새 envelope를 기다리는 최대 시간(프록시의 제한보다 짧게)
+	sessionIdle  = 60 * time.Second // long-poll 세션에서 이 시간 동안 poll이 없으면 방에서 내보낸다.
+	maxPollBatch = 100              // poll 응답 하나에 담는 최대 envelope 수
+)
+
+// transportAPI는 웹 소켓을 쓸 수 없는 클라이언트(프록시 등)를 위한 HTTP 전송 방식이다.
+// 어느 방식이든 웹 소켓과 같은 client를 만들어 방에 들여보내므로, 방은 클라이언트가 어떻게 연결됐는지 모른다.
+// GET    /transport/{room}/events              - SSE로 envelope를 받는다.(첫 이벤트 transport에 세션 ID가 있음)
+// POST   /transport/{room}/poll                - long-poll 세션을 연다. -> {"session": id}
+// GET    /transport/{room}/poll?session={id}   - 새 envelope가 올 때까지(최대 pollTimeout) 기다렸다가 배열로 받는다.
+// DELETE /transport/{room}/poll?session={id}   - long-poll 세션을 닫는다.
+// POST   /transport/{room}/send?session={id}   - 웹 소켓과 같은 형식의 프레임 하나를 보낸다.(SSE, long-poll 공통)
+// 다시 연결할 때는 웹 소켓과 같이 ?epoch={epoch}&seq={seq}를 붙이면 놓친 이벤트만 받는다.
+// SSE는 이벤트 id가 {epoch}:{seq}이므로 브라우저가 보내는 Last-Event-ID만으로도 이어서 받는다.
+type transportAPI struct {
+	rooms *roomRegistry
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newTransportAPI(rooms *roomRegistry) *transportAPI {
+	return &transportAPI{rooms: rooms, sessions: make(map[string]*session)}
+}
+
+// session은 HTTP 요청 여러 개에 걸쳐 방에 들어가 있는 클라이언트 하나이다.
+type session struct {
+	id     string
+	client *client
+	room   *room       // 실제로 들어간 방
+	idle   *time.Timer // long-poll 세션의 정리 타이머(SSE는 nil)
+
+	polling chan struct{} // 동시에 poll 하나만 받기 위한 세마포어
+	sendMu  sync.Mutex    // 핸들러가 read 고루틴 하나에서 호출되는 것처럼 send 요청을 하나씩 처리
+	ended   chan struct{} // 세션이 끝나면 닫힌다.
+	endOnce sync.Once
+
+	// 서버가 세션을 끝낸 이유(ended가 닫히기 전에 설정한다. 0이면 방이 client에 남긴 closeCode를 쓴다.)
+	closeCode int
+	closeText string
+}
+
+func (t *transportAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segs := strings.Split(strings.Trim(req.URL.Path, "/"), "/") // ["transport", room, action]
+	if len(segs) != 3 || !roomNamePattern.MatchString(segs[1]) {
+		http.NotFound(w, req)
+		return
+	}
+	switch action := segs[2]; {
+	case action == "events" && req.Method == http.MethodGet:
+		t.events(w, req, segs[1])
+	case action == "poll" && req.Method == http.MethodPost:
+		t.open(w, req, segs[1])
+	case action == "poll" && req.Method == http.MethodGet:
+		t.poll(w, req)
+	case action == "poll" && req.Method == http.MethodDelete:
+		if s := t.lookup(w, req); s != nil {
+			t.end(s)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case action == "send" && req.Method == http.MethodPost:
+		t.send(w, req)
+	case action == "events" || action == "poll" || action == "send":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// join은 요청한 사용자의 client를 만들어 name 방에 들여보내고 세션으로 등록한다. 실패하면 에러 응답을 보내고 nil을 리턴한다.
+// poll이 true이면(long-poll 세션) 등록하기 전에 정리 타이머를 만든다.(등록한 뒤에는 poll 요청이 바로 세션을 쓸 수 있다.)
+func (t *transportAPI) join(w http.ResponseWriter, req *http.Request, name string, poll bool) *session {
+	if !t.rooms.authenticate(w, req) {
+		return nil
+	}
+	r := t.rooms.get(name)
+	if r == nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+	userData, ok := r.authorize(w, req)
+	if !ok {
+		return nil
+	}
+	c := &client{
+		send:     make(chan *envelope, messageBufferSize),
+		room:     r,
+		codec:    jsonCodec{},
+		userData: userData,
+		resume:   parseResumePoint(req),
+	}
+	joined := r.admit(c)
+	if joined == nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+	s := &session{id: newSessionID(), client: c, room: joined, polling: make(chan struct{}, 1), ended: make(chan struct{})}
+	if poll {
+		s.idle = time.AfterFunc(sessionIdle, func() { t.endWith(s, closeIdle, "no poll for "+sessionIdle.String()) })
+	}
+	t.mu.Lock()
+	t.sessions[s.id] = s
+	t.mu.Unlock()
+	go func() { // 서버 종료 등으로 방이 끝나면 poll을 기다리지 않고 정리한다.
+		select {
+		case <-joined.done:
+			t.end(s)
+		case <-s.ended:
+		}
+	}()
+	return s
+}
+
+// end는 세션을 지우고 클라이언트를 방에서 내보낸다. 여러 번 호출해도 된다.
+func (t *transportAPI) end(s *session) {
+	t.endWith(s, 0, "")
+}
+
+// endWith는 end와 같지만, 세션이 처음 끝날 때 code와 reason을 남겨 gone이 알려줄 수 있게 한다.(code가 0이면 남기지 않음)
+func (t *transportAPI) endWith(s *session, code int, reason string) {
+	s.endOnce.Do(func() {
+		s.closeCode, s.closeText = code, reason
+		t.mu.Lock()
+		delete(t.sessions, s.id)
+		t.mu.Unlock()
+		if s.idle != nil {
+			s.idle.Stop()
+		}
+		close(s.ended)
+		s.room.exit(s.client)
+		s.room.wg.Done() // 웹 소켓 클라이언트의 read, write 고루틴 몫(room.admit 참고)
+		s.room.wg.Done()
+	})
+}
+
+// lookup은 ?session={id}의 세션을 찾는다. 세션이 없거나 다른 사용자의 것이면 에러 응답을 보내고 nil을 리턴한다.
+func (t *transportAPI) lookup(w http.ResponseWriter, req *http.Request) *session {
+	t.mu.Lock()
+	s := t.sessions[req.URL.Query().Get("session")]
+	t.mu.Unlock()
+	if s == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil
+	}
+	user, err := authUserData(req)
+	if err != nil || user.Get("userid").Str() != s.client.userID() {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return nil
+	}
+	return s
+}
+
+// events는 SSE 스트림으로 envelope를 보낸다. 연결이 끊기면 세션도 끝난다.
+func (t *transportAPI) events(w http.ResponseWriter, req *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	s := t.join(w, req, name, false)
+	if s == nil {
+		return
+	}
+	defer t.end(s)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx가 응답을 모아두지 않도록
+	fmt.Fprintf(w, "event: transport\ndata: {\"session\":%q}\n\n", s.id)
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingPeriod) // 프록시가 유휴 연결을 끊지 않도록 주석 줄을 보낸다.
+	defer ticker.Stop()
+	for {
+		select {
+		case env, ok := <-s.client.send:
+			if !ok { // 방이 내보냄
+				if s.client.closeCode != 0 {
+					fmt.Fprintf(w, "event: close\ndata: {\"code\":%d,\"reason\":%q}\n\n", s.client.closeCode, s.client.closeText)
+				}
+				flusher.Flush()
+				return
+			}
+			data, err := s.client.codec.Encode(env)
+			if err != nil {
+				s.room.tracer.Trace("Failed to encode envelope: ", err)
+				continue
+			}
+			if env.Seq != 0 {
+				fmt.Fprintf(w, "id: %s\n", sseEventID(s.room.epoch, env.Seq))
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data) // JSON 인코딩 결과에는 줄바꿈이 없다.
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// open은 long-poll 세션을 연다.
+func (t *transportAPI) open(w http.ResponseWriter, req *http.Request, name string) {
+	s := t.join(w, req, name, true)
+	if s == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"session": s.id})
+}
+
+// poll은 새 envelope가 올 때까지 기다렸다가 쌓인 것을 한꺼번에 배열로 돌려준다. 시간이 지나면 빈 배열을 돌려준다.
+// 방이 클라이언트를 내보냈으면 410 Gone을 돌려주며, 클라이언트는 세션을 다시 열어야 한다.
+func (t *transportAPI) poll(w http.ResponseWriter, req *http.Request) {
+	s := t.lookup(w, req)
+	if s == nil {
+		return
+	}
+	select {
+	case s.polling <- struct{}{}:
+		defer func() { <-s.polling }()
+	default:
+		http.Error(w, "another poll is in progress", http.StatusConflict)
+		return
+	}
+	if s.idle != nil { // poll을 기다리는 동안에는 정리하지 않는다.
+		s.idle.Stop()
+		defer s.idle.Reset(sessionIdle)
+	}
+
+	envs := make([]*envelope, 0, 1)
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	select {
+	case env, ok := <-s.client.send:
+		if !ok {
+			t.gone(w, s)
+			return
+		}
+		envs = append(envs, env)
+	case <-timeout.C:
+	case <-s.ended:
+		t.gone(w, s)
+		return
+	case <-req.Context().Done():
+		return
+	}
+drain:
+	for len(envs) > 0 && len(envs) < maxPollBatch { // 이미 쌓여 있는 것도 함께 보낸다.
+		select {
+		case env, ok := <-s.client.send:
+			if !ok {
+				defer t.end(s) // 받은 것은 보내고, 다음 poll은 404가 된다.
+				break drain
+			}
+			envs = append(envs, env)
+		default:
+			break drain
+		}
+	}
+	writeJSON(w, http.StatusOK, envs)
+}
+
+// gone은 방에서 내보내진 세션을 정리하고 이유를 알려준다.
+func (t *transportAPI) gone(w http.ResponseWriter, s *session) {
+	t.end(s)
+	closeCode, closeText := s.closeCode, s.closeText
+	if closeCode == 0 { // 방이 내보냈다.(send 채널을 닫기 전에 설정)
+		closeCode, closeText = s.client.closeCode, s.client.closeText
+	}
+	code := "closed"
+	switch closeCode {
+	case closeKicked:
+		code = "kicked"
+	case closeBanned:
+		code = "banned"
+	case closeIdle:
+		code = "idle"
+	}
+	writeJSON(w, http.StatusGone, errorPayload{Code: code, Message: closeText})
+}
+
+// send는 프레임 하나를 받아 웹 소켓의 read와 같이 처리한다. 잘못된 프레임이면 error envelope로 응답한다.
+func (t *transportAPI) send(w http.ResponseWriter, req *http.Request) {
+	s := t.lookup(w, req)
+	if s == nil {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxMessageSize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorEnvelope(&frameError{"malformed", "frame is too large"}))
+		return
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	f, err := s.client.codec.Decode(data)
+	if err == nil {
+		err = s.client.dispatch(f)
+	}
+	switch {
+	case err == errRoomClosed:
+		t.gone(w, s)
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, errorEnvelope(err))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand는 실패하지 않는다.
+	}
+	return hex.EncodeToString(b)
+}
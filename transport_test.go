@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func newTransportTest(t *testing.T) (*httptest.Server, *roomRegistry) {
+	reg := newRoomRegistry(func(name string) *room {
+		r := newRoom(name)
+		r.store = newMemoryStore()
+		return r
+	}, time.Minute)
+	srv := httptest.NewServer(newTransportAPI(reg))
+	t.Cleanup(srv.Close)
+	return srv, reg
+}
+
+func transportRequest(t *testing.T, method, url, userid, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := objx.New(map[string]interface{}{"userid": userid, "name": userid}).MustBase64()
+	req.AddCookie(&http.Cookie{Name: "auth", Value: cookie})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestTransportLongPoll(t *testing.T) {
+	srv, _ := newTransportTest(t)
+	base := srv.URL + "/transport/dev/"
+
+	res := transportRequest(t, http.MethodPost, base+"poll", "alice", "")
+	var opened struct{ Session string }
+	json.NewDecoder(res.Body).Decode(&opened)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || opened.Session == "" {
+		t.Fatalf("opening a session = %d %q; want 200 with a session", res.StatusCode, opened.Session)
+	}
+
+	res = transportRequest(t, http.MethodPost, base+"send?session="+opened.Session, "alice", `{"v":1,"type":"chat","payload":{"message":"hi"}}`)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("send = %d; want 204", res.StatusCode)
+	}
+	res = transportRequest(t, http.MethodPost, base+"send?session="+opened.Session, "mallory", `{}`)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("another user's send = %d; want 401", res.StatusCode)
+	}
+
+	var types []string
+	for len(types) == 0 || types[len(types)-1] != typeChat {
+		res = transportRequest(t, http.MethodGet, base+"poll?session="+opened.Session, "alice", "")
+		var envs []struct{ Type string }
+		json.NewDecoder(res.Body).Decode(&envs)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || len(envs) == 0 {
+			t.Fatalf("poll = %d with %d envelopes", res.StatusCode, len(envs))
+		}
+		for _, env := range envs {
+			types = append(types, env.Type)
+		}
+	}
+	if types[0] != typeSession {
+		t.Errorf("poll should start with the session envelope, got %v", types)
+	}
+
+	res = transportRequest(t, http.MethodDelete, base+"poll?session="+opened.Session, "alice", "")
+	res.Body.Close()
+	if res := transportRequest(t, http.MethodGet, base+"poll?session="+opened.Session, "alice", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("poll after close = %d; want 404", res.StatusCode)
+	}
+}
+
+func TestTransportSSE(t *testing.T) {
+	srv, reg := newTransportTest(t)
+	res := transportRequest(t, http.MethodGet, srv.URL+"/transport/dev/events", "bob", "")
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	lines := bufio.NewScanner(res.Body)
+	next := func() string {
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), "data: ") {
+				return strings.TrimPrefix(lines.Text(), "data: ")
+			}
+		}
+		t.Fatal("stream ended")
+		return ""
+	}
+	if data := next(); !strings.Contains(data, "session") {
+		t.Errorf("first event should carry the session, got %s", data)
+	}
+	if data := next(); !strings.Contains(data, `"type":"session"`) {
+		t.Errorf("the room should welcome an SSE client like any other, got %s", data)
+	}
+
+	reg.get("dev").forward <- &message{UserID: "alice", Message: "over SSE"}
+	for data := next(); !strings.Contains(data, "over SSE"); data = next() {
+	}
+}
+
+func TestTransportSSEResume(t *testing.T) {
+	srv, reg := newTransportTest(t)
+	stream := func(lastEventID string) (*http.Response, func() (id, data string)) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/transport/dev/events", nil)
+		cookie := objx.New(map[string]interface{}{"userid": "bob", "name": "bob"}).MustBase64()
+		req.AddCookie(&http.Cookie{Name: "auth", Value: cookie})
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bufio.NewScanner(res.Body)
+		return res, func() (id, data string) {
+			for lines.Scan() {
+				switch line := lines.Text(); {
+				case strings.HasPrefix(line, "id: "):
+					id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					return id, strings.TrimPrefix(line, "data: ")
+				}
+			}
+			t.Fatal("stream ended")
+			return "", ""
+		}
+	}
+
+	res, next := stream("")
+	reg.get("dev").forward <- &message{UserID: "alice", Message: "first"}
+	id, data := next()
+	for ; !strings.Contains(data, "first"); id, data = next() {
+	}
+	res.Body.Close()
+	if !strings.Contains(id, ":") {
+		t.Fatalf("SSE event id = %q; want {epoch}:{seq}", id)
+	}
+
+	reg.get("dev").forward <- &message{UserID: "alice", Message: "while away"}
+	res, next = stream(id) // 브라우저는 마지막으로 받은 id를 Last-Event-ID로 보낸다.
+	defer res.Body.Close()
+	next() // transport
+	if _, data := next(); !strings.Contains(data, `"resumed":true`) {
+		t.Errorf("reconnecting with Last-Event-ID should resume, got %s", data)
+	}
+	for _, data := next(); !strings.Contains(data, "while away"); _, data = next() {
+		if strings.Contains(data, "first") {
+			t.Fatal("resumed stream should not repeat events before Last-Event-ID")
+		}
+	}
+}
+
+func TestTransportIdleSessionGone(t *testing.T) {
+	reg := newRoomRegistry(newRoom, time.Minute)
+	api := newTransportAPI(reg)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	res := transportRequest(t, http.MethodPost, srv.URL+"/transport/dev/poll", "alice", "")
+	var opened struct{ Session string }
+	json.NewDecoder(res.Body).Decode(&opened)
+	res.Body.Close()
+	api.mu.Lock()
+	s := api.sessions[opened.Session]
+	api.mu.Unlock()
+	if s == nil || s.idle == nil {
+		t.Fatal("long-poll session should be registered with its idle timer")
+	}
+
+	api.endWith(s, closeIdle, "no poll") // 정리 타이머가 끝낸 것처럼
+	w := httptest.NewRecorder()
+	api.gone(w, s)
+	var e errorPayload
+	json.NewDecoder(w.Body).Decode(&e)
+	if w.Code != http.StatusGone || e.Code != "idle" {
+		t.Errorf("gone after idle = %d %+v; want 410 idle", w.Code, e)
+	}
+}
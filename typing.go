@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+const (
+	typingInterval = 2 * time.Second // 한 클라이언트가 typing 프레임을 보낼 수 있는 최소 간격(그보다 자주 오면 무시)
+	typingTimeout  = 5 * time.Second // 이 시간 동안 typing 프레임이 없으면 입력을 멈춘 것으로 본다.
+)
+
+// typingPayload는 typing 프레임의 payload이다.
+// 클라이언트는 {"active": false}로 입력을 멈췄다고 알릴 수 있고, payload가 없으면 입력 중으로 본다.
+type typingPayload struct {
+	UserID string `json:"userid,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Active bool   `json:"active"`
+}
+
+// typingSignal은 client.read가 room에 전달하는 입력 상태 변경이다.
+type typingSignal struct {
+	from   *client
+	active bool
+}
+
+// handleTyping은 typing 프레임을 처리한다. read 고루틴에서 클라이언트별로 보내는 빈도를 제한한 뒤 room에 전달한다.
+func (c *client) handleTyping(f *frame) error {
+	p := typingPayload{Active: true}
+	if len(f.Payload) > 0 {
+		if err := f.decodePayload(&p); err != nil {
+			return err
+		}
+	}
+	if p.Active {
+		now := time.Now()
+		if now.Sub(c.lastTyping) < typingInterval {
+			return nil // 너무 자주 보내면 조용히 버린다.
+		}
+		c.lastTyping = now
+	} else {
+		c.lastTyping = time.Time{}
+	}
+	select {
+	case c.room.typing <- typingSignal{from: c, active: p.Active}:
+		return nil
+	case <-c.room.done:
+		return errRoomClosed
+	}
+}
+
+// setTyping은 사용자의 입력 상태를 갱신하고 다른 클라이언트에게 알린다. run 루프 안에서만 호출해야 한다.
+// typing 이벤트는 기록에 저장하지 않는다.
+func (r *room) setTyping(c *client, active bool) {
+	userID := c.userID()
+	_, wasTyping := r.typists[userID]
+	if active {
+		r.typists[userID] = time.Now().Add(typingTimeout)
+	} else {
+		delete(r.typists, userID)
+	}
+	if active == wasTyping && !active {
+		return // 입력 중이 아니었는데 멈췄다는 신호는 보낼 필요가 없다.
+	}
+	env := newEnvelope(typeTyping, typingPayload{UserID: userID, Name: c.name(), Active: active})
+	for other := range r.clients {
+		if other.userID() != userID { // 자기 자신(다른 탭 포함)에게는 보내지 않는다.
+			r.sendTo(other, env)
+		}
+	}
+}
+
+// expireTyping은 typingTimeout이 지나도록 typing 프레임이 없던 사용자의 입력 상태를 끝낸다.
+func (r *room) expireTyping(now time.Time) {
+	for userID, deadline := range r.typists {
+		if now.After(deadline) {
+			delete(r.typists, userID)
+			r.broadcast(newEnvelope(typeTyping, typingPayload{UserID: userID, Name: r.memberName(userID), Active: false}))
+		}
+	}
+}
+
+// memberName은 방에 있는 사용자의 이름을 리턴한다.
+func (r *room) memberName(userID string) string {
+	if m, ok := r.members[userID]; ok {
+		return m.Name
+	}
+	return ""
+}
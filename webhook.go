@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 웹훅으로 보내는 이벤트 종류
+const (
+	hookMessage = "message" // 새 메시지(스레드 답글 포함)
+	hookJoin    = "join"    // 사용자가 방에 들어옴(첫 연결)
+	hookLeave   = "leave"   // 사용자가 방에서 나감(마지막 연결)
+)
+
+const (
+	webhookQueueSize   = 1024             // 보내기를 기다리는 이벤트 수(가득 차면 새 이벤트는 dead letter로 남긴다.)
+	webhookWorkers     = 4                // 동시에 보내는 요청 수
+	webhookAttempts    = 5                // 한 이벤트를 보내는 최대 시도 횟수
+	webhookTimeout     = 10 * time.Second // 요청 하나의 제한 시간
+	maxDeadLetters     = 100              // 웹훅마다 남겨두는 dead letter 수
+	webhookBackoffBase = time.Second      // 재시도 간격(1s, 2s, 4s, 8s ...)
+)
+
+// webhook은 방의 이벤트를 받는 HTTPS 주소 하나이다.
+type webhook struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"` // 비어있으면 모든 이벤트
+	Secret    string    `json:"secret,omitempty"` // HMAC-SHA256 서명 키(만들 때만 보여준다.)
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+func (h *webhook) wants(event string) bool {
+	return len(h.Events) == 0 || containsString(h.Events, event)
+}
+
+// webhookEvent는 웹훅으로 보내는 JSON 본문이다.
+type webhookEvent struct {
+	ID      string    `json:"id"` // 재시도해도 같은 값(받는 쪽에서 중복 확인)
+	Event   string    `json:"event"`
+	Room    string    `json:"room"`
+	Time    time.Time `json:"time"`
+	Message *message  `json:"message,omitempty"`
+	User    *member   `json:"user,omitempty"`
+}
+
+// deadLetter는 끝내 보내지 못한 이벤트의 기록이다.
+type deadLetter struct {
+	Event    webhookEvent `json:"event"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	At       time.Time    `json:"at"`
+}
+
+// webhookStore는 등록된 웹훅과 dead letter를 보관한다. path가 비어있지 않으면 바뀔 때마다 JSON 파일로 저장한다.
+// run 루프가 forRoom으로 읽으므로 파일은 mu를 푼 뒤에 쓴다.(update)
+type webhookStore struct {
+	mu     sync.RWMutex
+	fileMu sync.Mutex // 파일 쓰기 순서를 지킨다.(바꾼 순서대로 쓰도록 update 전체에서 잡는다.)
+	path   string
+	Hooks  map[string]*webhook      `json:"hooks"` // ID -> 웹훅
+	Dead   map[string][]*deadLetter `json:"dead"`  // 웹훅 ID -> 최근 dead letter
+}
+
+func newWebhookStore(path string) (*webhookStore, error) {
+	s := &webhookStore{path: path, Hooks: make(map[string]*webhook), Dead: make(map[string][]*deadLetter)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Hooks == nil {
+		s.Hooks = make(map[string]*webhook)
+	}
+	if s.Dead == nil {
+		s.Dead = make(map[string][]*deadLetter)
+	}
+	return s, nil
+}
+
+// update는 s.mu를 잡고 change로 바꾼 뒤, 바뀌었으면 잠금을 풀고 파일에 쓴다. change의 결과를 리턴한다.
+// 파일에 쓰는 동안 run 루프의 forRoom이 기다리지 않도록 s.mu 밖에서 쓴다.
+func (s *webhookStore) update(change func() bool) (bool, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	changed := change()
+	var data []byte
+	var err error
+	if changed && s.path != "" {
+		data, err = json.Marshal(s)
+	}
+	s.mu.Unlock()
+	if !changed || s.path == "" || err != nil {
+		return changed, err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil { // 서명 키가 들어있다.
+		return true, err
+	}
+	return true, os.Rename(tmp, s.path)
+}
+
+// add는 웹훅을 등록한다. ID와 서명 키는 여기서 정한다.
+func (s *webhookStore) add(h *webhook) error {
+	h.ID = randomHex(6)
+	h.Secret = randomHex(32)
+	h.Created = time.Now()
+	_, err := s.update(func() bool {
+		s.Hooks[h.ID] = h
+		return true
+	})
+	return err
+}
+
+func (s *webhookStore) remove(id string) (bool, error) {
+	return s.update(func() bool {
+		if _, ok := s.Hooks[id]; !ok {
+			return false
+		}
+		delete(s.Hooks, id)
+		delete(s.Dead, id)
+		return true
+	})
+}
+
+// get은 id 웹훅의 복사본을 리턴한다.
+func (s *webhookStore) get(id string) (webhook, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.Hooks[id]
+	if !ok {
+		return webhook{}, false
+	}
+	return *h, true
+}
+
+// forRoom은 room 방에서 event를 받는 웹훅의 ID를 리턴한다.
+func (s *webhookStore) forRoom(room, event string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for id, h := range s.Hooks {
+		if h.Room == room && h.wants(event) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// list는 room 방의 웹훅을 만든 순서대로 리턴한다.(room이 비어있으면 모두, 서명 키는 빼고)
+func (s *webhookStore) list(room string) []webhook {
+	s.mu.RLock()
+	out := make([]webhook, 0, len(s.Hooks))
+	for _, h := range s.Hooks {
+		if room == "" || h.Room == room {
+			c := *h
+			c.Secret = ""
+			out = append(out, c)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// bury는 보내지 못한 이벤트를 dead letter로 남긴다.(웹훅마다 최근 maxDeadLetters개)
+// 파일에 쓰므로 run 루프에서 호출하면 안 된다.(worker와 재시도 타이머만 호출한다.)
+func (s *webhookStore) bury(hookID string, d *deadLetter) error {
+	_, err := s.update(func() bool {
+		if _, ok := s.Hooks[hookID]; !ok {
+			return false // 그사이 지워진 웹훅
+		}
+		dead := append(s.Dead[hookID], d)
+		if len(dead) > maxDeadLetters {
+			dead = dead[len(dead)-maxDeadLetters:]
+		}
+		s.Dead[hookID] = dead
+		return true
+	})
+	return err
+}
+
+func (s *webhookStore) deadLetters(hookID string) []*deadLetter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*deadLetter(nil), s.Dead[hookID]...)
+}
+
+// hookDelivery는 웹훅 하나로 보낼 이벤트 하나이다.
+type hookDelivery struct {
+	hookID  string
+	event   webhookEvent
+	attempt int // 지금까지 시도한 횟수
+}
+
+// letter는 reason 때문에 보내지 못한 dl의 dead letter를 만든다.
+func (dl *hookDelivery) letter(reason string) *deadLetter {
+	return &deadLetter{Event: dl.event, Error: reason, Attempts: dl.attempt, At: time.Now()}
+}
+
+// webhookDispatcher는 room.run 루프 밖에서 웹훅을 보낸다.
+// 방은 emit으로 이벤트를 큐에 넣기만 하고 기다리지 않으므로, 느린 수신 서버가 채팅을 막지 않는다.
+type webhookDispatcher struct {
+	hooks    *webhookStore
+	client   *http.Client
+	backoff  time.Duration // 첫 재시도 간격(두 배씩 늘어난다.)
+	queue    chan *hookDelivery
+	overflow chan *deadLetterEntry // 큐가 가득 차서 dead letter로 남길 이벤트(run 루프 밖의 buryOverflow가 파일에 쓴다.)
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	dropped  uint64 // overflow까지 가득 차서 dead letter로도 남기지 못한 이벤트 수(atomic으로 접근)
+
+	mu      sync.Mutex
+	retries map[*hookDelivery]*time.Timer // 재시도를 기다리는 이벤트(종료할 때 dead letter로 남긴다.)
+}
+
+// deadLetterEntry는 웹훅 하나의 dead letter로 남길 기록이다.
+type deadLetterEntry struct {
+	hookID string
+	letter *deadLetter
+}
+
+func newWebhookDispatcher(hooks *webhookStore) *webhookDispatcher {
+	d := &webhookDispatcher{
+		hooks:    hooks,
+		client:   &http.Client{Timeout: webhookTimeout},
+		backoff:  webhookBackoffBase,
+		queue:    make(chan *hookDelivery, webhookQueueSize),
+		overflow: make(chan *deadLetterEntry, webhookQueueSize),
+		quit:     make(chan struct{}),
+		retries:  make(map[*hookDelivery]*time.Timer),
+	}
+	d.wg.Add(webhookWorkers + 1)
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+	go d.buryOverflow()
+	return d
+}
+
+// emit은 room 방의 event를 그 이벤트를 받는 웹훅마다 큐에 넣는다. 기다리지 않으므로 run 루프에서 호출해도 된다.
+func (d *webhookDispatcher) emit(room string, ev webhookEvent) {
+	ev.Room = room
+	ev.Time = time.Now()
+	for _, id := range d.hooks.forRoom(room, ev.Event) {
+		e := ev
+		e.ID = randomHex(8)
+		select {
+		case d.queue <- &hookDelivery{hookID: id, event: e}:
+		default: // run 루프에서 파일을 쓰지 않도록 dead letter는 buryOverflow에게 맡긴다.
+			d.discard(&hookDelivery{hookID: id, event: e}, "delivery queue is full")
+		}
+	}
+}
+
+// discard는 보내지 않을 이벤트를 dead letter로 남기도록 buryOverflow에게 넘긴다. 기다리지 않으므로 run 루프에서 호출해도 된다.
+// buryOverflow도 밀려 있으면 버리고 dropped를 센다.(buryOverflow가 로그로 남긴다.)
+func (d *webhookDispatcher) discard(dl *hookDelivery, reason string) {
+	select {
+	case d.overflow <- &deadLetterEntry{hookID: dl.hookID, letter: dl.letter(reason)}:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+}
+
+// buryOverflow는 overflow의 이벤트를 dead letter로 파일에 남긴다. 종료할 때는 남은 것까지 쓰고 끝난다.
+func (d *webhookDispatcher) buryOverflow() {
+	defer d.wg.Done()
+	var logged uint64
+	for {
+		select {
+		case e := <-d.overflow:
+			if err := d.hooks.bury(e.hookID, e.letter); err != nil {
+				log.Println("Failed to record webhook dead letter:", err)
+			}
+			if n := atomic.LoadUint64(&d.dropped); n != logged {
+				log.Println("webhooks: dropped", n, "events without a dead letter (queue full)")
+				logged = n
+			}
+		case <-d.quit:
+			for {
+				select {
+				case e := <-d.overflow:
+					d.hooks.bury(e.hookID, e.letter)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// enqueue는 재시도할 이벤트를 다시 큐에 넣는다. 큐가 가득 차면 dead letter로 남긴다.
+// 재시도 타이머의 고루틴에서만 호출하므로 파일을 써도 된다.
+func (d *webhookDispatcher) enqueue(dl *hookDelivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		d.hooks.bury(dl.hookID, dl.letter("delivery queue is full"))
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case dl := <-d.queue:
+			d.deliver(dl)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// deliver는 한 번 보내 보고, 실패하면 간격을 두 배씩 늘려 다시 큐에 넣는다. 끝내 실패하면 dead letter로 남긴다.
+// 기다리는 동안 worker를 붙잡지 않도록 재시도는 타이머로 예약한다.
+func (d *webhookDispatcher) deliver(dl *hookDelivery) {
+	h, ok := d.hooks.get(dl.hookID)
+	if !ok {
+		return // 지워진 웹훅
+	}
+	dl.attempt++
+	retry, err := d.post(&h, &dl.event)
+	if err == nil {
+		return
+	}
+	if !retry || dl.attempt >= webhookAttempts {
+		d.hooks.bury(h.ID, dl.letter(err.Error()))
+		return
+	}
+	wait := d.backoff << uint(dl.attempt-1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.quit: // 종료 중이면 재시도하지 않고 남긴다.
+		d.hooks.bury(dl.hookID, dl.letter("server shutting down"))
+		return
+	default:
+	}
+	d.wg.Add(1)
+	d.retries[dl] = time.AfterFunc(wait, func() {
+		defer d.wg.Done()
+		d.mu.Lock()
+		delete(d.retries, dl)
+		d.mu.Unlock()
+		select {
+		case <-d.quit:
+			d.hooks.bury(dl.hookID, dl.letter("server shutting down"))
+		default:
+			d.enqueue(dl)
+		}
+	})
+}
+
+// post는 서명한 이벤트를 보낸다. 다시 시도할 만한 실패(연결 실패, 5xx, 429)이면 retry가 true이다.
+func (d *webhookDispatcher) post(h *webhook, ev *webhookEvent) (retry bool, err error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-webhooks/1")
+	req.Header.Set("X-Chat-Event", ev.Event)
+	req.Header.Set("X-Chat-Delivery", ev.ID)
+	req.Header.Set("X-Chat-Timestamp", ts)
+	req.Header.Set("X-Chat-Signature", "sha256="+signWebhook(h.Secret, ts, body))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024)) // 연결을 다시 쓸 수 있도록 읽고 닫는다.
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint returned %s", res.Status)
+	default:
+		return false, fmt.Errorf("endpoint returned %s", res.Status)
+	}
+}
+
+// signWebhook은 "{timestamp}.{body}"의 HMAC-SHA256 값을 16진수로 리턴한다.
+// 받는 쪽은 X-Chat-Timestamp와 본문으로 같은 값을 계산해 X-Chat-Signature와 비교하고, 오래된 timestamp는 거절하면 된다.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hook은 방의 이벤트를 웹훅으로 보낸다. run 루프 안에서만 호출해야 한다.
+// worker가 나중에 인코딩하므로 run 루프가 바꿀 수 있는 값은 복사해서 넘긴다.
+func (r *room) hook(event string, ev webhookEvent) {
+	if r.hooks == nil {
+		return
+	}
+	if ev.Message != nil {
+		m := *ev.Message
+		m.acked = nil
+		ev.Message = &m
+	}
+	if ev.User != nil {
+		u := *ev.User
+		ev.User = &u
+	}
+	ev.Event = event
+	r.hooks.emit(r.name, ev)
+}
+
+// close는 worker를 멈춘다. 큐에 남았거나 재시도를 기다리던 이벤트는 보내지 않고 dead letter로 남긴다.
+func (d *webhookDispatcher) close() {
+	d.once.Do(func() {
+		close(d.quit)
+		d.mu.Lock()
+		for dl, timer := range d.retries {
+			if timer.Stop() { // 아직 실행되지 않은 재시도
+				d.hooks.bury(dl.hookID, dl.letter("server shutting down"))
+				d.wg.Done()
+			}
+			delete(d.retries, dl)
+		}
+		d.mu.Unlock()
+	})
+	d.wg.Wait()
+	for {
+		select {
+		case dl := <-d.queue:
+			d.hooks.bury(dl.hookID, dl.letter("server shutting down"))
+		default:
+			if n := atomic.LoadUint64(&d.dropped); n > 0 {
+				log.Println("webhooks: dropped", n, "events without a dead letter (queue full)")
+			}
+			return
+		}
+	}
+}
+
+// validWebhookURL은 웹훅 주소가 HTTPS인지 확인한다.
+func validWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid url")
+	}
+	if u.Scheme != "https" {
+		return errors.New("webhook url must use https")
+	}
+	return nil
+}
+
+// webhookAPI는 웹훅을 관리하는 API이다. auth 쿠키의 사용자가 admins에 있어야 한다.
+// GET    /api/webhooks?room={name}         - 웹훅 목록(room이 없으면 모두)
+// POST   /api/webhooks                     - {"room", "url", "events"}로 등록한다.(응답에만 서명 키가 있음)
+// DELETE /api/webhooks/{id}                - 등록을 지운다.
+// GET    /api/webhooks/{id}/dead-letters   - 끝내 보내지 못한 이벤트
+type webhookAPI struct {
+	hooks  *webhookStore
+	admins map[string]bool
+}
+
+func (a *webhookAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := authUserData(r)
+	if err != nil || user.Get("userid").Str() == "" {
+		http.Error(w, "invalid auth cookie", http.StatusUnauthorized)
+		return
+	}
+	if !a.admins[user.Get("userid").Str()] {
+		http.Error(w, "only moderators can manage webhooks", http.StatusForbidden)
+		return
+	}
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // ["api", "webhooks", ...]
+	switch {
+	case len(segs) == 2 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.hooks.list(r.URL.Query().Get("room")))
+	case len(segs) == 2 && r.Method == http.MethodPost:
+		var h webhook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&h); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if !roomNamePattern.MatchString(h.Room) {
+			http.Error(w, "invalid room", http.StatusBadRequest)
+			return
+		}
+		if err := validWebhookURL(h.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, ev := range h.Events {
+			if ev != hookMessage && ev != hookJoin && ev != hookLeave {
+				http.Error(w, "unknown event "+strconv.Quote(ev), http.StatusBadRequest)
+				return
+			}
+		}
+		h.CreatedBy = user.Get("userid").Str()
+		if err := a.hooks.add(&h); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, h)
+	case len(segs) == 3 && r.Method == http.MethodDelete:
+		ok, err := a.hooks.remove(segs[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(segs) == 4 && segs[3] == "dead-letters" && r.Method == http.MethodGet:
+		if _, ok := a.hooks.get(segs[2]); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.hooks.deadLetters(segs[2]))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var calls int32
+	received := make(chan webhookEvent, 1)
+	var secret string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		want := "sha256=" + signWebhook(secret, req.Header.Get("X-Chat-Timestamp"), body)
+		if req.Header.Get("X-Chat-Signature") != want {
+			t.Errorf("signature = %q; want %q", req.Header.Get("X-Chat-Signature"), want)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 { // 첫 시도는 실패시켜 재시도를 확인한다.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev webhookEvent
+		json.Unmarshal(body, &ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	hooks, _ := newWebhookStore("")
+	h := &webhook{Room: "dev", URL: srv.URL, Events: []string{hookMessage}}
+	hooks.add(h)
+	secret = h.Secret
+	d := newWebhookDispatcher(hooks)
+	d.client = srv.Client()
+	d.backoff = 10 * time.Millisecond
+	defer d.close()
+
+	r := newRoom("dev")
+	r.hooks = d
+	r.hook(hookJoin, webhookEvent{User: &member{UserID: "alice"}}) // 등록하지 않은 이벤트
+	r.hook(hookMessage, webhookEvent{Message: &message{ID: 7, UserID: "alice", Message: "hi"}})
+
+	select {
+	case ev := <-received:
+		if ev.Event != hookMessage || ev.Room != "dev" || ev.Message == nil || ev.Message.ID != 7 {
+			t.Errorf("event = %+v; want message 7 in dev", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("endpoint called %d times; want 2 (one retry)", n)
+	}
+	if dead := hooks.deadLetters(h.ID); len(dead) != 0 {
+		t.Errorf("dead letters = %d; want 0", len(dead))
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	hooks, _ := newWebhookStore(path)
+	h := &webhook{Room: "dev", URL: srv.URL}
+	hooks.add(h)
+	d := newWebhookDispatcher(hooks)
+	d.client = srv.Client()
+	d.backoff = time.Millisecond
+	defer d.close()
+
+	d.emit("dev", webhookEvent{Event: hookLeave, User: &member{UserID: "bob"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hooks.deadLetters(h.ID)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed delivery was not recorded as a dead letter")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != webhookAttempts {
+		t.Errorf("endpoint called %d times; want %d", n, webhookAttempts)
+	}
+
+	reloaded, err := newWebhookStore(path) // 웹훅과 dead letter는 다시 시작해도 남아있다.
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := reloaded.deadLetters(h.ID)
+	if len(dead) != 1 || dead[0].Attempts != webhookAttempts || dead[0].Event.User.UserID != "bob" {
+		t.Errorf("reloaded dead letters = %+v; want one for bob after %d attempts", dead, webhookAttempts)
+	}
+	if got, ok := reloaded.get(h.ID); !ok || got.Secret != h.Secret {
+		t.Error("reloaded webhook should keep its secret")
+	}
+}
+
+func TestValidWebhookURL(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"https://example.com/hook": true,
+		"http://example.com/hook":  false,
+		"example.com/hook":         false,
+		"https://":                 false,
+	} {
+		if err := validWebhookURL(raw); (err == nil) != ok {
+			t.Errorf("validWebhookURL(%q) = %v; want ok=%v", raw, err, ok)
+		}
+	}
+}
+
+func TestWebhookEmitBuriesWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	hooks, _ := newWebhookStore(path)
+	h := &webhook{Room: "dev", URL: "https://example.com/hook"}
+	hooks.add(h)
+	d := &webhookDispatcher{ // worker 없이 큐만 채운다.
+		hooks:    hooks,
+		queue:    make(chan *hookDelivery, 1),
+		overflow: make(chan *deadLetterEntry, 1),
+		quit:     make(chan struct{}),
+		retries:  make(map[*hookDelivery]*time.Timer),
+	}
+
+	d.emit("dev", webhookEvent{Event: hookJoin})
+	d.emit("dev", webhookEvent{Event: hookLeave})
+	d.emit("dev", webhookEvent{Event: hookMessage})
+	if dead := hooks.deadLetters(h.ID); len(dead) != 0 {
+		t.Errorf("emit should not write dead letters from the room loop, got %d", len(dead))
+	}
+	if n := atomic.LoadUint64(&d.dropped); n != 1 {
+		t.Errorf("dropped = %d; want 1 once the overflow is full too", n)
+	}
+
+	d.wg.Add(1)
+	go d.buryOverflow()
+	d.close() // 큐에 남은 이벤트도 dead letter로 남긴다.
+	dead := hooks.deadLetters(h.ID)
+	if len(dead) != 2 || dead[0].Event.Event != hookLeave || dead[1].Event.Event != hookJoin || dead[1].Error != "server shutting down" {
+		t.Errorf("dead letters = %+v; want the overflowed leave and the queued join", dead)
+	}
+}
+
+func TestWebhookCloseBuriesPendingRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	hooks, _ := newWebhookStore("")
+	h := &webhook{Room: "dev", URL: srv.URL}
+	hooks.add(h)
+	d := newWebhookDispatcher(hooks)
+	d.client = srv.Client()
+	d.backoff = time.Hour // 종료할 때까지 재시도하지 않는다.
+
+	d.emit("dev", webhookEvent{Event: hookJoin, User: &member{UserID: "alice"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.retries)
+		d.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed delivery was not scheduled for a retry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.close()
+	dead := hooks.deadLetters(h.ID)
+	if len(dead) != 1 || dead[0].Attempts != 1 || dead[0].Error != "server shutting down" {
+		t.Errorf("dead letters = %+v; want the pending retry recorded at shutdown", dead)
+	}
+}